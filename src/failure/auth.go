@@ -0,0 +1,92 @@
+package failure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// Every packet ends with a trailer that proves it came from a server that knows the cluster key:
+//
+//	sent at (unix nanoseconds) | nonce | HMAC-SHA256 of everything before the HMAC
+//
+// The send time and nonce stop old packets from being replayed. Packets older than
+// AuthReplayWindow are rejected, and so is any nonce seen again within that window.
+
+const authTrailerSize = 8 + 8 + sha256.Size
+
+var errBadMAC = errors.New("membership message failed authentication")
+
+// Nonces we have accepted recently, and when their packets were sent
+var seenNonces = map[uint64]time.Time{}
+var lastNonceSweep = time.Now()
+var seenNoncesMutex sync.Mutex
+
+// Returns a copy of the body with the trailer appended. Packets are signed as they are written,
+// so every copy a fault rule sends or holds back gets its own send time and nonce, and
+// duplicates aren't dropped as replays and delayed packets aren't stale.
+func signPacket(body []byte) []byte {
+	var nonce [8]byte
+	rand.Read(nonce[:])
+
+	packet := make([]byte, len(body), len(body)+authTrailerSize)
+	copy(packet, body)
+	packet = binary.BigEndian.AppendUint64(packet, uint64(time.Now().UnixNano()))
+	packet = append(packet, nonce[:]...)
+	return append(packet, packetMAC(packet)...)
+}
+
+// Checks the packet's HMAC, and returns the packet without its trailer along with when it was sent and its nonce
+func verifyPacket(packet []byte) (body []byte, sentAt time.Time, nonce uint64, err error) {
+	if len(packet) < authTrailerSize {
+		return nil, sentAt, 0, errTruncated
+	}
+	macStart := len(packet) - sha256.Size
+	if !hmac.Equal(packet[macStart:], packetMAC(packet[:macStart])) {
+		return nil, sentAt, 0, errBadMAC
+	}
+
+	body = packet[:len(packet)-authTrailerSize]
+	sentAt = time.Unix(0, int64(binary.BigEndian.Uint64(packet[len(body):])))
+	nonce = binary.BigEndian.Uint64(packet[len(body)+8:])
+	return
+}
+
+func packetMAC(data []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(shared.Config.ClusterKey))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Returns an error if the message is too old, or is a copy of one we already accepted
+func checkReplay(msg Message) error {
+	age := time.Since(msg.SentAt)
+	if age > shared.AuthReplayWindow || age < -shared.AuthReplayWindow {
+		return fmt.Errorf("%v from server %d was sent %v ago, outside the replay window", msg.Type, msg.Sender, age)
+	}
+
+	seenNoncesMutex.Lock()
+	defer seenNoncesMutex.Unlock()
+	if _, seen := seenNonces[msg.Nonce]; seen {
+		return fmt.Errorf("%v from server %d is a replay", msg.Type, msg.Sender)
+	}
+	seenNonces[msg.Nonce] = msg.SentAt
+
+	// Forget nonces that are too old to be accepted anyway
+	if time.Since(lastNonceSweep) > shared.AuthReplayWindow {
+		for nonce, sentAt := range seenNonces {
+			if time.Since(sentAt) > shared.AuthReplayWindow {
+				delete(seenNonces, nonce)
+			}
+		}
+		lastNonceSweep = time.Now()
+	}
+	return nil
+}
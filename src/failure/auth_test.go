@@ -0,0 +1,102 @@
+package failure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"shared"
+)
+
+func TestVerifyPacket(t *testing.T) {
+	body := []byte("some membership message")
+	packet := signPacket(body)
+
+	gotBody, sentAt, _, verifyErr := verifyPacket(packet)
+	if verifyErr != nil {
+		t.Fatalf("verifyPacket of a signed packet: %v", verifyErr)
+	}
+	if !bytes.Equal(gotBody, body) {
+		t.Errorf("got body %q, want %q", gotBody, body)
+	}
+	if age := time.Since(sentAt); age < 0 || age > time.Second {
+		t.Errorf("packet was sent %v ago, want just now", age)
+	}
+
+	flipped := func(index int) []byte {
+		changed := append([]byte(nil), packet...)
+		changed[index] ^= 1
+		return changed
+	}
+	tests := []struct {
+		name    string
+		packet  []byte
+		wantErr error
+	}{
+		{"changed body", flipped(0), errBadMAC},
+		{"changed send time", flipped(len(body)), errBadMAC},
+		{"changed nonce", flipped(len(body) + 8), errBadMAC},
+		{"changed MAC", flipped(len(packet) - 1), errBadMAC},
+		{"trailer cut off", packet[:authTrailerSize-1], errTruncated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, _, verifyErr := verifyPacket(test.packet); verifyErr != test.wantErr {
+				t.Errorf("got error %v, want %v", verifyErr, test.wantErr)
+			}
+		})
+	}
+
+	t.Run("other cluster key", func(t *testing.T) {
+		key := shared.Config.ClusterKey
+		shared.Config.ClusterKey = "another key"
+		defer func() { shared.Config.ClusterKey = key }()
+		if _, _, _, verifyErr := verifyPacket(packet); verifyErr != errBadMAC {
+			t.Errorf("got error %v, want %v", verifyErr, errBadMAC)
+		}
+	})
+}
+
+func TestCheckReplay(t *testing.T) {
+	now := time.Now()
+	// Nonces stay seen for the whole run, so every run of the test needs new ones
+	nonce := rand.Uint64()
+	tests := []struct {
+		name    string
+		msg     Message
+		wantErr bool
+	}{
+		{"fresh", Message{SentAt: now, Nonce: nonce + 1}, false},
+		{"same nonce again", Message{SentAt: now, Nonce: nonce + 1}, true},
+		{"another nonce", Message{SentAt: now, Nonce: nonce + 2}, false},
+		{"older than the window", Message{SentAt: now.Add(-2 * shared.AuthReplayWindow), Nonce: nonce + 3}, true},
+		{"from the future", Message{SentAt: now.Add(2 * shared.AuthReplayWindow), Nonce: nonce + 4}, true},
+		{"inside the window", Message{SentAt: now.Add(-shared.AuthReplayWindow / 2), Nonce: nonce + 5}, false},
+	}
+	// In order, since the replay case depends on the fresh one
+	for _, test := range tests {
+		if replayErr := checkReplay(test.msg); (replayErr != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, replayErr, test.wantErr)
+		}
+	}
+}
+
+func TestSignPacketTwice(t *testing.T) {
+	// Spare capacity, so signing in place would let the second copy overwrite the first
+	body := append(make([]byte, 0, 100), "some membership message"...)
+	packet := signPacket(body)
+	again := signPacket(body)
+
+	gotBody, _, nonce, verifyErr := verifyPacket(packet)
+	againBody, _, againNonce, againErr := verifyPacket(again)
+	if verifyErr != nil || againErr != nil {
+		t.Fatalf("verifyPacket errors: %v, %v", verifyErr, againErr)
+	}
+	if !bytes.Equal(gotBody, body) || !bytes.Equal(againBody, body) {
+		t.Errorf("signed bodies %q and %q, want %q", gotBody, againBody, body)
+	}
+	if nonce == againNonce {
+		t.Errorf("both copies have nonce %d, so the second would be dropped as a replay", nonce)
+	}
+}
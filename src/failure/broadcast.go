@@ -0,0 +1,81 @@
+package failure
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"shared"
+)
+
+// Membership updates are spread by piggybacking them on outgoing pings, like an infection.
+// Each update is sent RetransmitMult * log(n) times, which is enough for it to reach every
+// server with high probability, and then dropped. Updates that have been sent the fewest
+// times go first, so fresh news spreads before old news.
+
+// An update waiting to be piggybacked
+type broadcast struct {
+	id        MembershipId
+	transmits int
+	// Breaks ties between updates with the same number of transmits, newer goes first
+	order uint64
+}
+
+type broadcastQueue struct {
+	// Keyed by server number, since a newer update about a server makes the older one useless
+	updates   map[int]*broadcast
+	nextOrder uint64
+	mutex     sync.Mutex
+}
+
+var broadcasts = broadcastQueue{updates: map[int]*broadcast{}}
+
+// Queues an update to be piggybacked, replacing any update still queued for the same server
+func (queue *broadcastQueue) Queue(id MembershipId) {
+	queue.mutex.Lock()
+	queue.nextOrder++
+	queue.updates[id.ServNum] = &broadcast{id: id, order: queue.nextOrder}
+	queue.mutex.Unlock()
+}
+
+// Returns up to limit updates to piggyback on one message, counting it as a transmission of each.
+// Updates that have been sent enough times are dropped from the queue.
+func (queue *broadcastQueue) Next(limit int) (ids []MembershipId) {
+	maxTransmits := retransmitLimit(len(MemList.AliveServers()))
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pending := make([]*broadcast, 0, len(queue.updates))
+	for _, update := range queue.updates {
+		pending = append(pending, update)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].transmits != pending[j].transmits {
+			return pending[i].transmits < pending[j].transmits
+		}
+		return pending[i].order > pending[j].order
+	})
+
+	for i := 0; i < len(pending) && i < limit; i++ {
+		update := pending[i]
+		ids = append(ids, update.id)
+		update.transmits++
+		if update.transmits >= maxTransmits {
+			delete(queue.updates, update.id.ServNum)
+		}
+	}
+	return
+}
+
+// Returns how many updates are still waiting to be sent enough times
+func (queue *broadcastQueue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.updates)
+}
+
+// How many times each update is sent in a cluster of numServers servers
+func retransmitLimit(numServers int) int {
+	return shared.Config.Failure.RetransmitMult * int(math.Ceil(math.Log2(float64(numServers+1))))
+}
@@ -0,0 +1,70 @@
+package failure
+
+import (
+	"testing"
+
+	"shared"
+)
+
+func TestRetransmitLimit(t *testing.T) {
+	mult := shared.Config.Failure.RetransmitMult
+	tests := []struct {
+		numServers int
+		want       int
+	}{
+		{1, mult * 1},
+		{2, mult * 2},
+		{3, mult * 2},
+		{4, mult * 3},
+		{7, mult * 3},
+		{8, mult * 4},
+		{10, mult * 4},
+		{100, mult * 7},
+	}
+	for _, test := range tests {
+		if got := retransmitLimit(test.numServers); got != test.want {
+			t.Errorf("retransmitLimit(%d) = %d, want %d", test.numServers, got, test.want)
+		}
+	}
+}
+
+func TestBroadcastQueueOrder(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive, 2: Alive, 3: Alive})
+	queue := broadcastQueue{updates: map[int]*broadcast{}}
+	queue.Queue(MembershipId{ServNum: 2})
+	queue.Queue(MembershipId{ServNum: 3})
+
+	// Newer updates go first when both were sent as often
+	if got := queue.Next(1); len(got) != 1 || got[0].ServNum != 3 {
+		t.Fatalf("first Next(1) = %+v, want server 3", got)
+	}
+	// Then the one sent fewer times
+	if got := queue.Next(1); len(got) != 1 || got[0].ServNum != 2 {
+		t.Fatalf("second Next(1) = %+v, want server 2", got)
+	}
+
+	// A new update about a server replaces the queued one, and starts over
+	queue.Queue(MembershipId{ServNum: 2, Incarnation: 1})
+	if got := queue.Next(1); len(got) != 1 || got[0].ServNum != 2 || got[0].Incarnation != 1 {
+		t.Fatalf("Next(1) after requeueing = %+v, want server 2 with incarnation 1", got)
+	}
+	if queue.Len() != 2 {
+		t.Errorf("queue has %d updates, want 2", queue.Len())
+	}
+}
+
+func TestBroadcastQueueDropsAfterLimit(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive, 2: Alive, 3: Alive, 4: Failed})
+	limit := retransmitLimit(3)
+	queue := broadcastQueue{updates: map[int]*broadcast{}}
+	queue.Queue(MembershipId{ServNum: 4, State: Failed})
+
+	for i := 0; i < limit; i++ {
+		if got := queue.Next(shared.Config.Failure.MaxPiggyback); len(got) != 1 {
+			t.Fatalf("transmission %d got %d updates, want 1", i+1, len(got))
+		}
+	}
+	if got := queue.Next(shared.Config.Failure.MaxPiggyback); len(got) != 0 {
+		t.Errorf("update was sent again after %d transmissions", limit)
+	}
+}
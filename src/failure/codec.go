@@ -0,0 +1,256 @@
+package failure
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every UDP packet the failure detector sends is a Message encoded in this compact binary format:
+//
+//	magic (2 bytes) | version | type | sender | target | part | parts | count | count * entry | auth trailer
+//	entry: server number | timestamp (unix nanoseconds) | incarnation | state | heartbeat | metadata version
+//
+// All the numbers are varints. Messages with more entries than fit in one packet
+// are split into several parts, each of which can be used on its own.
+// Every packet is signed with the cluster key, see auth.go for the trailer.
+
+type MessageType uint8
+
+const (
+	PingMsg MessageType = iota + 1
+	// Asks the receiver to ping Target for the sender
+	PingReqMsg
+	// Says Target answered a ping, Target is the sender itself unless the ACK was relayed
+	ACKMsg
+	JoinMsg
+	JoinReplyMsg
+	// Carries the sender's heartbeat and gossip, and isn't ACKed
+	HeartbeatMsg
+	// Carries the sender's whole membership list, to reconcile after a partition
+	MergeMsg
+	MergeReplyMsg
+)
+
+type Message struct {
+	Type   MessageType
+	Sender int
+	Target int
+	Ids    []MembershipId
+	// Which part of a split up message this is, counting from 0, and how many parts there are
+	Part  int
+	Parts int
+	// Filled in when a packet is decoded, to check it isn't a replay
+	SentAt time.Time
+	Nonce  uint64
+}
+
+const wireVersion = 4
+
+var wireMagic = [2]byte{'D', 'S'}
+
+// Packets are kept under a typical MTU so they don't get fragmented
+const maxDatagramSize = 1400
+
+// Big enough for any UDP packet, so a bad sender can't get us to read half a message
+const receiveBufferSize = 65536
+
+// The most bytes a single entry can take up
+const maxEntrySize = 5*binary.MaxVarintLen64 + 1
+
+// The fewest bytes an entry can take up, used to sanity check counts
+const minEntrySize = 6
+
+const maxParts = 255
+
+func (msgType MessageType) String() string {
+	switch msgType {
+	case PingMsg:
+		return "Ping"
+	case PingReqMsg:
+		return "PingReq"
+	case ACKMsg:
+		return "ACK"
+	case JoinMsg:
+		return "Join"
+	case JoinReplyMsg:
+		return "JoinReply"
+	case HeartbeatMsg:
+		return "Heartbeat"
+	case MergeMsg:
+		return "Merge"
+	case MergeReplyMsg:
+		return "MergeReply"
+	}
+	return fmt.Sprintf("MessageType(%d)", uint8(msgType))
+}
+
+// Encodes the message into one or more packet bodies, each at most maxDatagramSize bytes once
+// signPacket adds the trailer
+func (msg *Message) Encode() (packets [][]byte, err error) {
+	header := []byte{wireMagic[0], wireMagic[1], wireVersion, byte(msg.Type)}
+	header = binary.AppendUvarint(header, uint64(msg.Sender))
+	header = binary.AppendUvarint(header, uint64(msg.Target))
+	// Room for the part, number of parts, and entry count that go after the header, and the auth trailer
+	room := maxDatagramSize - len(header) - 2 - binary.MaxVarintLen64 - authTrailerSize
+
+	// Fit as many entries as possible into each packet
+	var groups [][]byte
+	var counts []int
+	var group []byte
+	count := 0
+	for _, id := range msg.Ids {
+		entry := encodeEntry(id)
+		if count > 0 && len(group)+len(entry) > room {
+			groups, counts = append(groups, group), append(counts, count)
+			group, count = nil, 0
+		}
+		group = append(group, entry...)
+		count++
+	}
+	groups, counts = append(groups, group), append(counts, count)
+
+	if len(groups) > maxParts {
+		return nil, fmt.Errorf("%v message with %d entries is too big to send", msg.Type, len(msg.Ids))
+	}
+	for part, group := range groups {
+		packet := append([]byte(nil), header...)
+		packet = append(packet, byte(part), byte(len(groups)))
+		packet = binary.AppendUvarint(packet, uint64(counts[part]))
+		packets = append(packets, append(packet, group...))
+	}
+	return
+}
+
+func encodeEntry(id MembershipId) []byte {
+	entry := make([]byte, 0, maxEntrySize)
+	entry = binary.AppendUvarint(entry, uint64(id.ServNum))
+	entry = binary.AppendVarint(entry, id.TimeStamp.UnixNano())
+	entry = binary.AppendUvarint(entry, id.Incarnation)
+	entry = append(entry, byte(id.State))
+	entry = binary.AppendUvarint(entry, id.Heartbeat)
+	return binary.AppendUvarint(entry, id.MetaVersion)
+}
+
+// Decodes a single packet, checking its signature and every length against what was actually received
+func DecodeMessage(packet []byte) (msg Message, err error) {
+	if len(packet) < 2 || packet[0] != wireMagic[0] || packet[1] != wireMagic[1] {
+		return msg, errors.New("not a membership message")
+	}
+	body, sentAt, nonce, authErr := verifyPacket(packet)
+	if authErr != nil {
+		return msg, authErr
+	}
+	msg.SentAt, msg.Nonce = sentAt, nonce
+	reader := wireReader{buf: body}
+
+	header := reader.bytes(4)
+	if reader.err != nil || header[0] != wireMagic[0] || header[1] != wireMagic[1] {
+		return msg, errors.New("not a membership message")
+	}
+	if header[2] != wireVersion {
+		return msg, fmt.Errorf("unsupported membership message version %d", header[2])
+	}
+	msg.Type = MessageType(header[3])
+	if msg.Type < PingMsg || msg.Type > MergeReplyMsg {
+		return msg, fmt.Errorf("unknown membership message type %d", header[3])
+	}
+
+	msg.Sender = reader.number()
+	msg.Target = reader.number()
+	partBytes := reader.bytes(2)
+	count := reader.uvarint()
+	if reader.err != nil {
+		return msg, reader.err
+	}
+	msg.Part, msg.Parts = int(partBytes[0]), int(partBytes[1])
+	if msg.Parts == 0 || msg.Part >= msg.Parts {
+		return msg, fmt.Errorf("bad part %d of %d", msg.Part, msg.Parts)
+	}
+	if count > uint64(reader.remaining()/minEntrySize) {
+		return msg, fmt.Errorf("message says it has %d entries but is only %d bytes", count, len(packet))
+	}
+
+	for i := uint64(0); i < count; i++ {
+		var id MembershipId
+		id.ServNum = reader.number()
+		timeStamp := reader.varint()
+		id.Incarnation = reader.uvarint()
+		id.State = MemberState(reader.bytes(1)[0])
+		id.Heartbeat = reader.uvarint()
+		id.MetaVersion = reader.uvarint()
+		if reader.err != nil {
+			return msg, reader.err
+		}
+		if id.State > Left {
+			return msg, fmt.Errorf("unknown state %d for server %d", id.State, id.ServNum)
+		}
+		id.TimeStamp = time.Unix(0, timeStamp)
+		msg.Ids = append(msg.Ids, id)
+	}
+	if reader.remaining() != 0 {
+		return msg, fmt.Errorf("%d extra bytes after message", reader.remaining())
+	}
+	return
+}
+
+// Reads values off the front of a packet, remembering the first error so callers can check once
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+var errTruncated = errors.New("membership message is cut off")
+
+func (reader *wireReader) remaining() int {
+	return len(reader.buf)
+}
+
+func (reader *wireReader) bytes(n int) []byte {
+	if reader.err == nil && len(reader.buf) < n {
+		reader.err = errTruncated
+	}
+	if reader.err != nil {
+		return make([]byte, n)
+	}
+	ret := reader.buf[:n]
+	reader.buf = reader.buf[n:]
+	return ret
+}
+
+func (reader *wireReader) uvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(reader.buf)
+	if n <= 0 {
+		reader.err = errTruncated
+		return 0
+	}
+	reader.buf = reader.buf[n:]
+	return value
+}
+
+func (reader *wireReader) varint() int64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(reader.buf)
+	if n <= 0 {
+		reader.err = errTruncated
+		return 0
+	}
+	reader.buf = reader.buf[n:]
+	return value
+}
+
+// Server numbers have to fit in an int
+func (reader *wireReader) number() int {
+	value := reader.uvarint()
+	if value > uint64(^uint(0)>>1) {
+		reader.err = fmt.Errorf("server number %d is too big", value)
+		return 0
+	}
+	return int(value)
+}
@@ -0,0 +1,131 @@
+package failure
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testIds(count int) (ids []MembershipId) {
+	for i := 0; i < count; i++ {
+		ids = append(ids, MembershipId{
+			TimeStamp:   time.Unix(1540000000+int64(i), int64(i)*1000),
+			ServNum:     i%10 + 1,
+			Incarnation: uint64(i % 3),
+			State:       MemberState(i % 4),
+			Heartbeat:   uint64(i * 7),
+			MetaVersion: uint64(i % 5),
+		})
+	}
+	return
+}
+
+func sameIds(a, b []MembershipId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameId(a[i], b[i]) || a[i].Heartbeat != b[i].Heartbeat || a[i].MetaVersion != b[i].MetaVersion {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       Message
+		wantParts int
+	}{
+		{"ping without ids", Message{Type: PingMsg, Sender: 1, Target: 2}, 1},
+		{"ACK with a few ids", Message{Type: ACKMsg, Sender: 3, Target: 3, Ids: testIds(4)}, 1},
+		{"merge split into parts", Message{Type: MergeMsg, Sender: 10, Ids: testIds(200)}, 0},
+		{"big server numbers", Message{Type: HeartbeatMsg, Sender: 1 << 40, Target: 1 << 20, Ids: []MembershipId{{TimeStamp: time.Unix(0, 1<<62), ServNum: 1 << 40, Incarnation: 1 << 62}}}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets, encodeErr := test.msg.Encode()
+			if encodeErr != nil {
+				t.Fatalf("Encode: %v", encodeErr)
+			}
+			if test.wantParts != 0 && len(packets) != test.wantParts {
+				t.Errorf("got %d packets, want %d", len(packets), test.wantParts)
+			}
+
+			var ids []MembershipId
+			for part, body := range packets {
+				packet := signPacket(body)
+				if len(packet) > maxDatagramSize {
+					t.Errorf("part %d is %d bytes, more than %d", part, len(packet), maxDatagramSize)
+				}
+				msg, decodeErr := DecodeMessage(packet)
+				if decodeErr != nil {
+					t.Fatalf("DecodeMessage part %d: %v", part, decodeErr)
+				}
+				if msg.Type != test.msg.Type || msg.Sender != test.msg.Sender || msg.Target != test.msg.Target {
+					t.Errorf("got %v from %d to %d, want %v from %d to %d", msg.Type, msg.Sender, msg.Target, test.msg.Type, test.msg.Sender, test.msg.Target)
+				}
+				if msg.Part != part || msg.Parts != len(packets) {
+					t.Errorf("got part %d of %d, want %d of %d", msg.Part, msg.Parts, part, len(packets))
+				}
+				ids = append(ids, msg.Ids...)
+			}
+			if !sameIds(ids, test.msg.Ids) {
+				t.Errorf("got ids %+v, want %+v", ids, test.msg.Ids)
+			}
+		})
+	}
+}
+
+func TestEncodeTooManyParts(t *testing.T) {
+	msg := Message{Type: MergeMsg, Sender: 1, Ids: testIds(maxParts * maxDatagramSize / minEntrySize)}
+	if _, encodeErr := msg.Encode(); encodeErr == nil {
+		t.Error("Encode of a message that needs more than maxParts packets succeeded")
+	}
+}
+
+func TestDecodeMessageRejectsBadInput(t *testing.T) {
+	packets, _ := (&Message{Type: PingMsg, Sender: 2, Target: 3, Ids: testIds(3)}).Encode()
+	// Bodies are changed before signing, since tampering with a signed packet only trips the MAC
+	body := packets[0]
+	header := []byte{wireMagic[0], wireMagic[1], wireVersion, byte(PingMsg), 2, 3}
+
+	withByte := func(index int, value byte) []byte {
+		changed := append([]byte(nil), body...)
+		changed[index] = value
+		return changed
+	}
+	withCount := func(parts []byte, count uint64) []byte {
+		packet := append(append([]byte(nil), header...), parts...)
+		return binary.AppendUvarint(packet, count)
+	}
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		wantErr string
+	}{
+		{"empty", nil, "not a membership message"},
+		{"wrong magic", []byte("GET / HTTP/1.1\r\n"), "not a membership message"},
+		{"shorter than the trailer", []byte{wireMagic[0], wireMagic[1], 1, 2, 3}, "cut off"},
+		{"wrong version", signPacket(withByte(2, wireVersion+1)), "version"},
+		{"unknown type", signPacket(withByte(3, 200)), "unknown membership message type"},
+		{"truncated header", signPacket(body[:5]), "cut off"},
+		{"truncated entry", signPacket(body[:len(body)-3]), "cut off"},
+		{"extra bytes", signPacket(append(append([]byte(nil), body...), 0)), "extra bytes"},
+		{"count bigger than the packet", signPacket(withCount([]byte{0, 1}, 1000)), "entries"},
+		{"part past the end", signPacket(withCount([]byte{2, 2}, 0)), "bad part"},
+		{"no parts", signPacket(withCount([]byte{0, 0}, 0)), "bad part"},
+		{"unknown state", signPacket(append(withCount([]byte{0, 1}, 1), 1, 2, 0, 9, 0, 0)), "unknown state"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, decodeErr := DecodeMessage(test.packet)
+			if decodeErr == nil || !strings.Contains(decodeErr.Error(), test.wantErr) {
+				t.Errorf("got error %v, want one containing %q", decodeErr, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package failure
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// To check whether every server agrees on the membership list, we ask every alive server for its
+// view over RPC and compare them entry by entry, ignoring heartbeats. For every server the views
+// disagree on, we print what each view holds next to ours, and how long the views that are behind
+// have been behind the newest one. For the last change every view agrees on, we print how long it
+// took from the first server seeing it to the last one. The times come from each server's own
+// clock, so they are only as good as the clocks are in sync.
+
+// One entry of a server's membership list
+type ViewEntry struct {
+	// The id without the heartbeat, which changes every round
+	Id MembershipId
+	// When the entry last changed state or run, or zero for a tombstone
+	Changed time.Time
+}
+
+type ViewArgs struct{}
+
+type ViewReply struct {
+	Entries []ViewEntry
+}
+
+func (membership *Membership) View(args *ViewArgs, reply *ViewReply) error {
+	reply.Entries = MemList.view()
+	return nil
+}
+
+// Returns every entry in the membership list, including the graveyard
+func (ml *MembershipList) view() (entries []ViewEntry) {
+	for _, servNum := range ml.ServerNumbers() {
+		entry := ml.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		entry.Mutex.Lock()
+		id := entry.Id
+		id.Heartbeat = 0
+		entries = append(entries, ViewEntry{Id: id, Changed: entry.StateChanged})
+		entry.Mutex.Unlock()
+	}
+	for _, id := range ml.Tombstones() {
+		id.Heartbeat = 0
+		entries = append(entries, ViewEntry{Id: id})
+	}
+	return
+}
+
+// Returns whether the id would override the other one in the membership list
+func isNewer(id, other MembershipId) bool {
+	if !id.TimeStamp.Equal(other.TimeStamp) {
+		return id.TimeStamp.After(other.TimeStamp)
+	}
+	if id.Incarnation != other.Incarnation {
+		return id.Incarnation > other.Incarnation
+	}
+	return id.State > other.State
+}
+
+// Returns whether the ids are the same, ignoring heartbeats. Times that came over RPC have lost
+// their monotonic clock reading, so they have to be compared with Equal.
+func sameId(id, other MembershipId) bool {
+	return id.TimeStamp.Equal(other.TimeStamp) && id.ServNum == other.ServNum &&
+		id.Incarnation == other.Incarnation && id.State == other.State
+}
+
+func viewIdStr(id MembershipId) string {
+	return fmt.Sprintf("%v (incarnation %d, run started %s)", id.State, id.Incarnation, id.TimeStamp.Format("15:04:05.000"))
+}
+
+// Asks every alive server for its view, keyed by server and then by the server each entry is about
+func gatherViews() (views map[int]map[int]ViewEntry, failures string) {
+	type result struct {
+		server  int
+		entries []ViewEntry
+		err     error
+	}
+	servers := MemList.AliveServers()
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		go func(server int) {
+			if server == ownServerNum {
+				results <- result{server, MemList.view(), nil}
+				return
+			}
+			var reply ViewReply
+			askErr := callMembership(server, "Membership.View", &ViewArgs{}, &reply)
+			results <- result{server, reply.Entries, askErr}
+		}(server)
+	}
+
+	views = map[int]map[int]ViewEntry{}
+	for range servers {
+		res := <-results
+		if res.err != nil {
+			failures += fmt.Sprintf("Couldn't get the view of server %d: %v\n", res.server, res.err)
+			continue
+		}
+		view := map[int]ViewEntry{}
+		for _, entry := range res.entries {
+			view[entry.Id.ServNum] = entry
+		}
+		views[res.server] = view
+	}
+	return
+}
+
+// Compares the view of every alive server with ours, and returns every disagreement, how far
+// behind the views that disagree are, and how long the last change took to reach every view
+func ConvergenceStr() (ret string) {
+	// Measured from when we asked, since a server that doesn't answer holds up the rest
+	askedAt := time.Now()
+	views, failures := gatherViews()
+	var viewers []int
+	newest := map[int]ViewEntry{}
+	for viewer, view := range views {
+		viewers = append(viewers, viewer)
+		for servNum, entry := range view {
+			if held, ok := newest[servNum]; !ok || isNewer(entry.Id, held.Id) {
+				newest[servNum] = entry
+			}
+		}
+	}
+	sort.Ints(viewers)
+	var servNums []int
+	for servNum := range newest {
+		servNums = append(servNums, servNum)
+	}
+	sort.Ints(servNums)
+
+	ours := views[ownServerNum]
+	disagreements := 0
+	var lastChange MembershipId
+	var lastFirstSeen, lastAllSeen time.Time
+	for _, servNum := range servNums {
+		newestId := newest[servNum].Id
+
+		// When the first view to have the newest id got it, and when the last one did
+		var firstSeen, allSeen time.Time
+		var behind []int
+		for _, viewer := range viewers {
+			entry, ok := views[viewer][servNum]
+			if !ok || !sameId(entry.Id, newestId) {
+				behind = append(behind, viewer)
+				continue
+			}
+			if entry.Changed.IsZero() {
+				continue
+			}
+			if firstSeen.IsZero() || entry.Changed.Before(firstSeen) {
+				firstSeen = entry.Changed
+			}
+			if entry.Changed.After(allSeen) {
+				allSeen = entry.Changed
+			}
+		}
+
+		if len(behind) == 0 {
+			if !firstSeen.IsZero() && firstSeen.After(lastFirstSeen) {
+				lastChange, lastFirstSeen, lastAllSeen = newestId, firstSeen, allSeen
+			}
+			continue
+		}
+
+		disagreements++
+		staleness := ""
+		if !firstSeen.IsZero() {
+			staleness = fmt.Sprintf(", %v behind", askedAt.Sub(firstSeen).Round(time.Millisecond))
+		}
+		if entry, ok := ours[servNum]; !ok {
+			ret += fmt.Sprintf("Server %d: we have never heard of it%s\n", servNum, staleness)
+		} else if !sameId(entry.Id, newestId) {
+			ret += fmt.Sprintf("Server %d: we have %s%s\n", servNum, viewIdStr(entry.Id), staleness)
+		} else {
+			ret += fmt.Sprintf("Server %d: we have %s, the newest\n", servNum, viewIdStr(entry.Id))
+		}
+		for _, viewer := range viewers {
+			if viewer == ownServerNum {
+				continue
+			}
+			entry, ok := views[viewer][servNum]
+			ourEntry, weHaveIt := ours[servNum]
+			switch {
+			case !ok:
+				ret += fmt.Sprintf("  server %d has never heard of it%s\n", viewer, staleness)
+			case weHaveIt && sameId(entry.Id, ourEntry.Id):
+				continue
+			case !sameId(entry.Id, newestId):
+				ret += fmt.Sprintf("  server %d has %s%s\n", viewer, viewIdStr(entry.Id), staleness)
+			default:
+				ret += fmt.Sprintf("  server %d has %s, the newest\n", viewer, viewIdStr(entry.Id))
+			}
+		}
+	}
+
+	header := fmt.Sprintf("Compared the views of servers %s\n", strings.Trim(fmt.Sprint(viewers), "[]"))
+	if disagreements == 0 {
+		header += fmt.Sprintf("Every view agrees on all %d servers\n", len(servNums))
+	} else {
+		header += fmt.Sprintf("The views disagree on %d of %d servers\n", disagreements, len(servNums))
+	}
+	ret = header + ret
+	if !lastFirstSeen.IsZero() {
+		ret += fmt.Sprintf("Last change every view agrees on: server %d became %s %v ago, and every view had it within %v\n",
+			lastChange.ServNum, viewIdStr(lastChange), askedAt.Sub(lastFirstSeen).Round(time.Millisecond),
+			lastAllSeen.Sub(lastFirstSeen).Round(time.Millisecond))
+	}
+	return ret + failures
+}
@@ -0,0 +1,189 @@
+package failure
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"shared"
+)
+
+// A way of finding out which servers have failed. They all share the membership list,
+// the ports, suspicion and the piggybacked updates, and differ in how they probe.
+type FailureDetector interface {
+	// Opens the ports and starts probing in the background
+	Start()
+	// Adds us to the group through the seed nodes, retrying in the background until it works
+	Join()
+	// Tells every alive server we are leaving and stops the process
+	Leave()
+	// Returns every server in the membership list, including failed ones
+	Members() []MembershipId
+	// Returns a channel that gets an event for every membership change from now on
+	Subscribe() <-chan MembershipEvent
+}
+
+// The failure detector picked by the cluster config
+var Detector FailureDetector
+
+// Names of the detectors that can be picked in the cluster config
+const (
+	PingDetectorName     = "ping"
+	AllToAllDetectorName = "alltoall"
+	GossipDetectorName   = "gossip"
+	PhiDetectorName      = "phi"
+)
+
+// Names of the ways the ping detector can pick whom to ping
+const (
+	FingerProbingName     = "finger"
+	RoundRobinProbingName = "roundrobin"
+)
+
+// Returns the detector with the given name, probing the way named by probing
+func newDetector(name string, probing string) (FailureDetector, error) {
+	switch probing {
+	case FingerProbingName, "", RoundRobinProbingName:
+	default:
+		return nil, fmt.Errorf("unknown probing %q", probing)
+	}
+	if probing == RoundRobinProbingName && name != PingDetectorName && name != "" {
+		return nil, fmt.Errorf("only the %s detector can probe in %s order", PingDetectorName, RoundRobinProbingName)
+	}
+
+	switch name {
+	case PingDetectorName, "":
+		if probing == RoundRobinProbingName {
+			return &pingDetector{roundRobin: &roundRobin{inOrder: map[int]bool{}}}, nil
+		}
+		return &pingDetector{}, nil
+	case AllToAllDetectorName:
+		return &heartbeatDetector{allToAll: true}, nil
+	case GossipDetectorName:
+		return &heartbeatDetector{allToAll: false}, nil
+	case PhiDetectorName:
+		return &phiDetector{}, nil
+	}
+	return nil, fmt.Errorf("unknown failure detector %q", name)
+}
+
+// Pings the servers in the finger table, or the next few in round robin order, and suspects
+// them if neither they nor anyone probing them indirectly gets an ACK back
+type pingDetector struct {
+	baseDetector
+	// Nil to ping the finger table
+	roundRobin *roundRobin
+}
+
+func (detector *pingDetector) Start() {
+	detector.openPorts()
+	if detector.roundRobin != nil {
+		go PingIntervalFunction(func() []int { return detector.roundRobin.next(shared.FingerTableSize) })
+	} else {
+		go PingIntervalFunction(fingerTargets)
+	}
+}
+
+// What every detector does the same way
+type baseDetector struct{}
+
+func (detector *baseDetector) openPorts() {
+	OpenPortForPing()
+	OpenPortForACK()
+	OpenPortForIntroducer()
+	go checkSuspicions()
+	go watchForPartitions(subscribe())
+	go mergeWithFailedServers()
+	go collectTombstones()
+	go saveSnapshots()
+	go fetchMetadata()
+}
+
+func (detector *baseDetector) Join() {
+	// Add yourself to your membership table
+	servNum := ownServerNum
+	self := MemList.getOrAdd(servNum)
+	self.Mutex.Lock()
+	oldId := self.Id
+	self.Id.ServNum = servNum
+	self.Id.TimeStamp = time.Now()
+	self.StateChanged = self.Id.TimeStamp
+	self.Meta = ownMetadata()
+	self.Id.MetaVersion, self.MetaHeld = 1, 1
+	broadcasts.Queue(self.Id)
+	recordTransition(oldId, self.Id, ownServerNum, "joined the group")
+	self.Mutex.Unlock()
+
+	MemList.markChanged()
+
+	fileLog.Printf("Server %d joining the network\n", servNum)
+
+	go joinThroughSeeds()
+}
+
+// Marks us as left and tells every alive server directly, instead of waiting for it to be
+// gossiped, so nobody mistakes the leave for a failure. The news is sent again to whoever hasn't
+// ACKed it until LeaveACKs servers have, or LeaveTimeout passes, while it is also piggybacked.
+func (detector *baseDetector) Leave() {
+	self := MemList.Get(ownServerNum)
+
+	self.Mutex.Lock()
+	self.setState(Left, "left the group")
+	leftId := self.Id
+	self.Mutex.Unlock()
+
+	MemList.markChanged()
+	if saveErr := saveSnapshot(); saveErr != nil {
+		fileLog.Printf("Couldn't save the membership snapshot: %v\n", saveErr)
+	}
+
+	var peers []int
+	for _, servNum := range MemList.AliveServers() {
+		if servNum != ownServerNum {
+			peers = append(peers, servNum)
+		}
+	}
+	wanted := shared.LeaveACKs
+	if wanted > len(peers) {
+		wanted = len(peers)
+	}
+	sentAt := time.Now()
+	acked := 0
+	for deadline := sentAt.Add(shared.LeaveTimeout); ; time.Sleep(shared.LeaveResendInterval) {
+		acked = 0
+		for _, servNum := range peers {
+			if ackedSince(servNum, sentAt) {
+				acked++
+			} else {
+				sendMessageNow(servNum, pingPort, Message{Type: PingMsg, Sender: ownServerNum, Ids: []MembershipId{leftId}})
+			}
+		}
+		if acked >= wanted || time.Now().After(deadline) {
+			break
+		}
+	}
+	fileLog.Printf("Told the other servers that I left with incarnation %d, %d of them ACKed\n", leftId.Incarnation, acked)
+
+	// Stop your own process
+	fileLog.Printf("Leaving the failure detector peacefully. Goodbye!")
+	log.Println("Ending process normally")
+	os.Exit(0)
+}
+
+func (detector *baseDetector) Members() (ids []MembershipId) {
+	for _, servNum := range MemList.ServerNumbers() {
+		entry := MemList.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		entry.Mutex.Lock()
+		ids = append(ids, entry.Id)
+		entry.Mutex.Unlock()
+	}
+	return
+}
+
+func (detector *baseDetector) Subscribe() <-chan MembershipEvent {
+	return subscribe()
+}
@@ -0,0 +1,150 @@
+package failure
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Membership changes are published as events to every subscriber. Publishing never blocks the
+// failure detector: each subscriber has its own queue holding the latest event for each server,
+// so a slow subscriber sees fewer, coalesced events instead of holding up gossip.
+
+type EventType uint8
+
+const (
+	// A server we hadn't heard of before
+	JoinedEvent EventType = iota + 1
+	SuspectedEvent
+	FailedEvent
+	// A server that left on purpose
+	LeftEvent
+	// A server that restarted, or came back after being marked failed or left
+	RejoinedEvent
+	// A suspected server that proved it was alive
+	RefutedEvent
+)
+
+type MembershipEvent struct {
+	Type        EventType
+	ServNum     int
+	Incarnation uint64
+	Time        time.Time
+}
+
+type subscriber struct {
+	events chan MembershipEvent
+	// The latest undelivered event for each server, delivered in the order servers first got one
+	pending map[int]MembershipEvent
+	order   []int
+	mutex   sync.Mutex
+	// Wakes up the delivery goroutine, never holds more than one signal
+	wake chan struct{}
+}
+
+var subscribers []*subscriber
+var subscribersMutex sync.Mutex
+
+func (eventType EventType) String() string {
+	switch eventType {
+	case JoinedEvent:
+		return "Joined"
+	case SuspectedEvent:
+		return "Suspected"
+	case FailedEvent:
+		return "Failed"
+	case LeftEvent:
+		return "Left"
+	case RejoinedEvent:
+		return "Rejoined"
+	case RefutedEvent:
+		return "Refuted"
+	}
+	return fmt.Sprintf("EventType(%d)", uint8(eventType))
+}
+
+func (event MembershipEvent) String() string {
+	return fmt.Sprintf("server %d %v (incarnation %d)", event.ServNum, event.Type, event.Incarnation)
+}
+
+// Returns a channel that gets an event for every membership change from now on
+func subscribe() <-chan MembershipEvent {
+	sub := &subscriber{
+		events:  make(chan MembershipEvent),
+		pending: map[int]MembershipEvent{},
+		wake:    make(chan struct{}, 1),
+	}
+	go sub.deliver()
+
+	subscribersMutex.Lock()
+	subscribers = append(subscribers, sub)
+	subscribersMutex.Unlock()
+	return sub.events
+}
+
+// Works out which event, if any, going from oldId to newId is, and sends it to every subscriber
+func publishTransition(oldId, newId MembershipId) {
+	var eventType EventType
+	switch {
+	case oldId.TimeStamp.IsZero():
+		eventType = map[MemberState]EventType{Alive: JoinedEvent, Suspect: JoinedEvent, Failed: FailedEvent, Left: LeftEvent}[newId.State]
+	case newId.TimeStamp.After(oldId.TimeStamp):
+		eventType = RejoinedEvent
+	case newId.State == oldId.State:
+		return
+	case newId.State == Suspect:
+		eventType = SuspectedEvent
+	case newId.State == Failed:
+		eventType = FailedEvent
+	case newId.State == Left:
+		eventType = LeftEvent
+	case oldId.State == Suspect:
+		eventType = RefutedEvent
+	default:
+		eventType = RejoinedEvent
+	}
+	publish(MembershipEvent{Type: eventType, ServNum: newId.ServNum, Incarnation: newId.Incarnation, Time: time.Now()})
+}
+
+func publish(event MembershipEvent) {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for _, sub := range subscribers {
+		sub.queue(event)
+	}
+}
+
+// Queues the event, replacing any undelivered event about the same server
+func (sub *subscriber) queue(event MembershipEvent) {
+	sub.mutex.Lock()
+	if _, ok := sub.pending[event.ServNum]; !ok {
+		sub.order = append(sub.order, event.ServNum)
+	}
+	sub.pending[event.ServNum] = event
+	sub.mutex.Unlock()
+
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Hands queued events to the subscriber as fast as it takes them
+func (sub *subscriber) deliver() {
+	for range sub.wake {
+		for {
+			sub.mutex.Lock()
+			if len(sub.order) == 0 {
+				sub.mutex.Unlock()
+				break
+			}
+			servNum := sub.order[0]
+			sub.order = sub.order[1:]
+			event := sub.pending[servNum]
+			delete(sub.pending, servNum)
+			sub.mutex.Unlock()
+
+			sub.events <- event
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package failure
+
+import (
+	"testing"
+	"time"
+)
+
+// Subscribes, and returns the subscriber along with its channel
+func testSubscriber() (*subscriber, <-chan MembershipEvent) {
+	events := subscribe()
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	return subscribers[len(subscribers)-1], events
+}
+
+// Waits until the subscriber's delivery goroutine has taken every queued event
+func waitForDelivery(t *testing.T, sub *subscriber) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		sub.mutex.Lock()
+		pending := len(sub.order)
+		sub.mutex.Unlock()
+		if pending == 0 {
+			return
+		}
+	}
+	t.Fatal("queued events were never picked up for delivery")
+}
+
+func nextEvent(t *testing.T, events <-chan MembershipEvent) MembershipEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered")
+	}
+	return MembershipEvent{}
+}
+
+func TestSubscriberCoalescesEvents(t *testing.T) {
+	sub, events := testSubscriber()
+
+	// The first event is taken for delivery at once, and waits for us to read it
+	sub.queue(MembershipEvent{Type: JoinedEvent, ServNum: 2})
+	waitForDelivery(t, sub)
+
+	// Meanwhile, later events about the same server replace each other
+	sub.queue(MembershipEvent{Type: SuspectedEvent, ServNum: 2})
+	sub.queue(MembershipEvent{Type: JoinedEvent, ServNum: 3})
+	sub.queue(MembershipEvent{Type: FailedEvent, ServNum: 2})
+
+	want := []MembershipEvent{{Type: JoinedEvent, ServNum: 2}, {Type: FailedEvent, ServNum: 2}, {Type: JoinedEvent, ServNum: 3}}
+	for i, wantEvent := range want {
+		if got := nextEvent(t, events); got.Type != wantEvent.Type || got.ServNum != wantEvent.ServNum {
+			t.Errorf("event %d is %v, want %v", i, got, wantEvent)
+		}
+	}
+	select {
+	case extra := <-events:
+		t.Errorf("got extra event %v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPublishTransition(t *testing.T) {
+	_, events := testSubscriber()
+	run := time.Unix(2, 0)
+	id := func(timeStamp time.Time, state MemberState) MembershipId {
+		return MembershipId{TimeStamp: timeStamp, ServNum: 2, State: state}
+	}
+	tests := []struct {
+		name string
+		old  MembershipId
+		new  MembershipId
+		want EventType
+	}{
+		{"first heard of", MembershipId{}, id(run, Alive), JoinedEvent},
+		{"first heard of as failed", MembershipId{}, id(run, Failed), FailedEvent},
+		{"suspected", id(run, Alive), id(run, Suspect), SuspectedEvent},
+		{"failed", id(run, Suspect), id(run, Failed), FailedEvent},
+		{"left", id(run, Alive), id(run, Left), LeftEvent},
+		{"refuted", id(run, Suspect), id(run, Alive), RefutedEvent},
+		{"back after failing", id(run, Failed), id(run, Alive), RejoinedEvent},
+		{"new run", id(run, Failed), id(run.Add(time.Second), Alive), RejoinedEvent},
+		{"no change", id(run, Alive), id(run, Alive), 0},
+	}
+	for _, test := range tests {
+		publishTransition(test.old, test.new)
+		if test.want == 0 {
+			select {
+			case event := <-events:
+				t.Errorf("%s: got %v, want no event", test.name, event)
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		if got := nextEvent(t, events); got.Type != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got.Type, test.want)
+		}
+	}
+}
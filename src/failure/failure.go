@@ -1,13 +1,13 @@
 package failure
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/fatih/color"
 	"log"
+	"math/rand"
 	"net"
-	"os"
-	"strconv"
+	"net/rpc"
+	"sort"
 	"sync"
 	"time"
 
@@ -20,22 +20,54 @@ type ServerInfo struct {
 	Hostname string
 }
 
-// How individual entries in the membership list are identified
+// How individual entries in the membership list are identified.
+// TimeStamp changes every time the server process starts, and Incarnation is bumped
+// by the server itself whenever it has to refute a report that it failed.
 type MembershipId struct {
-	TimeStamp time.Time
-	ServNum   uint8
-	Failed    bool
+	TimeStamp   time.Time
+	ServNum     int
+	Incarnation uint64
+	State       MemberState
+	// Bumped by the server itself every round when heartbeating, and left at 0 when pinging
+	Heartbeat uint64
+	// Bumped by the server itself whenever its metadata changes, see metadata.go
+	MetaVersion uint64
 }
 
+// Where a server is in its lifecycle. For the same incarnation, a later state overrides an earlier one.
+type MemberState uint8
+
+const (
+	Alive MemberState = iota
+	Suspect
+	Failed
+	Left
+)
+
 type MembershipEntry struct {
-	Id          MembershipId
-	Changed     bool
-	ReceivedACK bool
-	Mutex       sync.Mutex
+	Id           MembershipId
+	LastACK      time.Time
+	StateChanged time.Time
+	// When the server's heartbeat last went up
+	LastHeard time.Time
+	// The gaps between the last few ACKs, for the phi detector
+	ACKIntervals []time.Duration
+	// When we last pinged the server directly and haven't had the ACK yet, and how long the last few ACKs took
+	LastPingSent time.Time
+	RTTs         []time.Duration
+	// The server's metadata, which is never changed in place, and its version
+	Meta     map[string]string
+	MetaHeld uint64
+	Mutex    sync.Mutex
 }
 
+// Servers is keyed by server number, and only holds servers we have heard from.
+// Graveyard holds the last id of every server dropped from Servers after failing or leaving,
+// so old news about it can't bring it back. Both are guarded by ServersMutex.
 type MembershipList struct {
-	Servers       [shared.NumServers + 1]MembershipEntry
+	Servers       map[int]*MembershipEntry
+	Graveyard     map[int]MembershipId
+	ServersMutex  sync.RWMutex
 	UpdateFT      bool
 	UpdateFTMutex sync.Mutex
 }
@@ -44,41 +76,85 @@ type FingerTable struct {
 	Entries [shared.FingerTableSize]ServerInfo
 }
 
-var Introducer = ServerInfo{1, shared.GetServerAddressFromNumber(1)}
-
-var ownServerNum = shared.GetOwnServerNumber()
-var MemList MembershipList
+var ownServerNum int
+var MemList = MembershipList{Servers: map[int]*MembershipEntry{}, Graveyard: map[int]MembershipId{}}
 var fingerTable FingerTable
-var fileLog = shared.OpenLogFile(fmt.Sprintf("detectFail%d.log", ownServerNum))
+var fileLog *log.Logger
+
+// One server asking us to ping a target for it. Each request is its own value, so a request
+// that times out can be removed without touching later ones from the same server.
+type indirectRequest struct {
+	requester int
+}
+
+// Requests to ping a target for another server, keyed by the target
+var indirectRequests = map[int][]*indirectRequest{}
+var indirectMutex sync.Mutex
 var green = color.New(color.FgGreen).SprintFunc()
 var red = color.New(color.FgRed).SprintFunc()
+var yellow = color.New(color.FgYellow).SprintFunc()
+var blue = color.New(color.FgBlue).SprintFunc()
+
+// How often to check whether suspected servers have run out of time
+const suspicionCheckInterval = 250 * time.Millisecond
 
-const memListBufferSize int = 1024
+// Returns where to reach the port picked out by portOf on the given server
+func serverEndpoint(servNum int, portOf func(shared.Ports) int) string {
+	node := shared.GetNode(servNum)
+	return node.Endpoint(portOf(node.Ports))
+}
+func pingPort(ports shared.Ports) int       { return ports.Ping }
+func ackPort(ports shared.Ports) int        { return ports.ACK }
+func introducerPort(ports shared.Ports) int { return ports.Introducer }
+
+func (state MemberState) String() string {
+	switch state {
+	case Alive:
+		return "Alive"
+	case Suspect:
+		return "Suspect"
+	case Failed:
+		return "Failed"
+	case Left:
+		return "Left"
+	}
+	return fmt.Sprintf("MemberState(%d)", uint8(state))
+}
 
 func (servInf *ServerInfo) Str() string {
 	return fmt.Sprintf("ServerID: %2d", servInf.Number)
 }
 func (mlId *MembershipId) Str() string {
-	return fmt.Sprintf("Server Number: %d\nTimestamp: %v\nFailed: %v", mlId.ServNum, mlId.TimeStamp, mlId.Failed)
+	return fmt.Sprintf("Server Number: %d\nTimestamp: %v\nIncarnation: %d\nState: %v\nHeartbeat: %d\nMetadata version: %d", mlId.ServNum, mlId.TimeStamp, mlId.Incarnation, mlId.State, mlId.Heartbeat, mlId.MetaVersion)
 }
 func (mlEntry *MembershipEntry) Str() (ret string) {
 	mlEntry.Mutex.Lock()
-	ret = fmt.Sprintf("%s\nChanged: %v\nReceivedACK: %v\n", mlEntry.Id.Str(), mlEntry.Changed, mlEntry.ReceivedACK)
+	ret = fmt.Sprintf("%s\nLastACK: %v\nRTT: %s\n", mlEntry.Id.Str(), mlEntry.LastACK, mlEntry.rttStr())
 	mlEntry.Mutex.Unlock()
 	return
 }
 func (ml *MembershipList) Str(onlyPrintNums bool) (ret string) {
-	for _, entry := range ml.Servers {
-		if entry.Id.ServNum != 0 {
-			if onlyPrintNums {
-				if entry.Id.Failed {
-					ret += fmt.Sprintf("%s, ", red(entry.Id.ServNum))
-				} else {
-					ret += fmt.Sprintf("%s, ", green(entry.Id.ServNum))
-				}
-			} else {
-				ret += entry.Str() + "\n"
+	for _, servNum := range ml.ServerNumbers() {
+		entry := ml.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		if onlyPrintNums {
+			entry.Mutex.Lock()
+			state := entry.Id.State
+			entry.Mutex.Unlock()
+			switch state {
+			case Alive:
+				ret += fmt.Sprintf("%s, ", green(servNum))
+			case Suspect:
+				ret += fmt.Sprintf("%s, ", yellow(servNum))
+			case Failed:
+				ret += fmt.Sprintf("%s, ", red(servNum))
+			case Left:
+				ret += fmt.Sprintf("%s, ", blue(servNum))
 			}
+		} else {
+			ret += entry.Str() + "\n"
 		}
 	}
 	if ret == "" {
@@ -98,248 +174,511 @@ func (ft *FingerTable) Str() (ret string) {
 	return
 }
 
-// This function assumes you already have the lock to the entry
-func (mlEntry *MembershipEntry) markFailed() {
-	mlEntry.Id.Failed = true
-	mlEntry.Changed = true
+// Changes the state because of something we saw ourselves, for the given reason.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) setState(state MemberState, reason string) {
+	oldId := mlEntry.Id
+	mlEntry.Id.State = state
+	mlEntry.StateChanged = time.Now()
+	broadcasts.Queue(mlEntry.Id)
+	recordTransition(oldId, mlEntry.Id, ownServerNum, reason)
+}
+
+// Returns the entry for the server, or nil if we have never heard of it or it was dropped
+func (ml *MembershipList) Get(servNum int) *MembershipEntry {
+	ml.ServersMutex.RLock()
+	defer ml.ServersMutex.RUnlock()
+	return ml.Servers[servNum]
+}
+
+// Returns the entry for the server, adding one if we don't have it.
+// A dropped server starts from its tombstone, so coming back counts as rejoining.
+func (ml *MembershipList) getOrAdd(servNum int) *MembershipEntry {
+	ml.ServersMutex.Lock()
+	defer ml.ServersMutex.Unlock()
+	entry, ok := ml.Servers[servNum]
+	if !ok {
+		entry = &MembershipEntry{Id: ml.Graveyard[servNum]}
+		delete(ml.Graveyard, servNum)
+		ml.Servers[servNum] = entry
+	}
+	return entry
+}
+
+// Returns the number of every server in the list in increasing order, failed or not
+func (ml *MembershipList) ServerNumbers() (servNums []int) {
+	ml.ServersMutex.RLock()
+	for servNum := range ml.Servers {
+		servNums = append(servNums, servNum)
+	}
+	ml.ServersMutex.RUnlock()
+	sort.Ints(servNums)
+	return
+}
+
+// Returns the state of the server, and false if we have never heard from it
+func (ml *MembershipList) State(servNum int) (state MemberState, known bool) {
+	entry := ml.Get(servNum)
+	if entry == nil {
+		return Failed, false
+	}
+	entry.Mutex.Lock()
+	state, known = entry.Id.State, !entry.Id.TimeStamp.IsZero()
+	entry.Mutex.Unlock()
+	return
+}
+
+// Returns whether we have heard from the server and haven't declared it failed.
+// Suspected servers still count as alive, so a short hiccup doesn't move their files around.
+func (ml *MembershipList) IsAlive(servNum int) bool {
+	state, known := ml.State(servNum)
+	return known && (state == Alive || state == Suspect)
 }
 
-func (ml *MembershipList) GetChanged(returnAll bool) (changedML []MembershipId) {
-	for i, entry := range ml.Servers {
+// Returns the numbers of the servers we think are alive in increasing order
+func (ml *MembershipList) AliveServers() (alive []int) {
+	for _, servNum := range ml.ServerNumbers() {
+		if ml.IsAlive(servNum) {
+			alive = append(alive, servNum)
+		}
+	}
+	return
+}
+
+// Returns the ids of every server that hasn't failed or left, for sending to new members
+func (ml *MembershipList) GetAll() (ids []MembershipId) {
+	for _, servNum := range ml.ServerNumbers() {
+		entry := ml.Get(servNum)
+		if entry == nil {
+			continue
+		}
 		entry.Mutex.Lock()
-		if entry.Changed == true || (returnAll && entry.Id.ServNum != 0 && !entry.Id.Failed) {
-			changedML = append(changedML, entry.Id)
-			ml.Servers[i].Changed = false
+		if entry.Id.State == Alive || entry.Id.State == Suspect {
+			ids = append(ids, entry.Id)
 		}
 		entry.Mutex.Unlock()
 	}
 	return
 }
 
-// Update the membership list
-func (ml *MembershipList) Update(changedIds []MembershipId) {
+// Update the membership list with the ids the relayer sent us
+func (ml *MembershipList) Update(changedIds []MembershipId, relayer int) {
 	for _, newId := range changedIds {
 		servNum := newId.ServNum
-		update := false
-
-		var memLists shared.MemLists
-		for i:=0; i<=10; i++ {
-			MemList.Servers[i].Mutex.Lock()
-			memLists.OldList = append(memLists.OldList, !(MemList.Servers[i].Id.Failed))
-			MemList.Servers[i].Mutex.Unlock()
+		if shared.GetNode(servNum) == nil {
+			fileLog.Printf("Ignoring update about server %d, which isn't in the cluster config\n", servNum)
+			continue
+		}
+		if ml.isStale(newId) {
+			continue
 		}
+		update := false
+		reason := ""
 
-		ml.Servers[servNum].Mutex.Lock()
+		entry := ml.getOrAdd(servNum)
+		entry.Mutex.Lock()
 
 		// Update if we don't have the server id
 		// Update if new timestamp is later
+		// Refute it if someone says we failed
+		// Update if new incarnation is later, since the server refuted its failure
 		// Update if new entry says it failed but we thought it was alive
-		if newId.ServNum != ml.Servers[servNum].Id.ServNum {
+		if entry.Id.TimeStamp.IsZero() {
 			fileLog.Printf("Server %d has joined the network\n", servNum)
+			reason = "first heard of"
 			update = true
-		} else if newId.TimeStamp.After(ml.Servers[servNum].Id.TimeStamp) {
+		} else if newId.TimeStamp.After(entry.Id.TimeStamp) {
 			fileLog.Printf("Server %d has rejoined us!\n", servNum)
+			reason = "rejoined with a new run"
 			update = true
-		} else if newId.Failed == true && ml.Servers[servNum].Id.Failed == false {
-			if int(newId.ServNum) == ownServerNum {
-				fileLog.Printf("Everyone thinks I'm a failure\n")
-				time.Sleep(500 * time.Millisecond)
-				println("Restarting own process (not really right now")
-				//Join()
-			} else {
+		} else if newId.TimeStamp.Before(entry.Id.TimeStamp) {
+			// Old news about an earlier run of the server, ignore it
+		} else if servNum == ownServerNum {
+			if (newId.State == Suspect || newId.State == Failed) && entry.Id.State == Alive && newId.Incarnation >= entry.Id.Incarnation {
+				entry.Id.Incarnation = newId.Incarnation + 1
+				broadcasts.Queue(entry.Id)
+				fileLog.Printf("Someone thinks I'm %v, refuting with incarnation %d\n", newId.State, entry.Id.Incarnation)
+				health.raise(fmt.Sprintf("had to refute being %v", newId.State))
+				history.add(Transition{Time: time.Now(), ServNum: servNum, Known: true, OldState: newId.State, NewState: Alive,
+					Incarnation: entry.Id.Incarnation, Relayer: relayer, RecordedBy: ownServerNum, Reason: "refuted a report about itself"})
+			}
+		} else if newId.Incarnation > entry.Id.Incarnation || (newId.Incarnation == entry.Id.Incarnation && newId.State > entry.Id.State) {
+			if newId.State == Alive && entry.Id.State != Alive {
+				fileLog.Printf("Server %d refuted being %v with incarnation %d\n", servNum, entry.Id.State, newId.Incarnation)
+				reason = "refuted with a higher incarnation"
+			} else if newId.State == Suspect && entry.Id.State != Suspect {
+				fileLog.Printf("I received a message that server %d is suspected\n", servNum)
+				reason = "reported suspected"
+			} else if newId.State == Failed && entry.Id.State != Failed {
 				fileLog.Printf("I received a message that server %d has failed\n", servNum)
-				update = true
+				reason = "reported failed"
+			} else if newId.State == Left && entry.Id.State != Left {
+				fileLog.Printf("Server %d has left the group\n", servNum)
+				reason = "left the group"
+			}
+			update = true
+		}
+
+		// A newer heartbeat only shows the server is still running, so it isn't passed on
+		sameRun := newId.TimeStamp.Equal(entry.Id.TimeStamp)
+		if servNum != ownServerNum && sameRun && newId.Heartbeat > entry.Id.Heartbeat {
+			entry.Id.Heartbeat = newId.Heartbeat
+			entry.LastHeard = time.Now()
+		}
+
+		// A newer metadata version is passed on, and fetchMetadata gets the metadata itself
+		if servNum != ownServerNum && sameRun && newId.MetaVersion > entry.Id.MetaVersion {
+			entry.Id.MetaVersion = newId.MetaVersion
+			if !update {
+				broadcasts.Queue(entry.Id)
 			}
 		}
 
 		// Update the entry
 		if update == true {
-			ml.Servers[servNum].Id = newId
-			ml.Servers[servNum].Changed = true
+			// A new run counts as a change even in the same state, so it shows when we heard of it
+			if newId.State != entry.Id.State || !sameRun {
+				entry.StateChanged = time.Now()
+			}
+			if sameRun && entry.Id.Heartbeat > newId.Heartbeat {
+				newId.Heartbeat = entry.Id.Heartbeat
+			}
+			if sameRun && entry.Id.MetaVersion > newId.MetaVersion {
+				newId.MetaVersion = entry.Id.MetaVersion
+			}
+			// Metadata from an earlier run means nothing now
+			if !sameRun {
+				entry.Meta, entry.MetaHeld = nil, 0
+			}
+			if newId.State == Alive {
+				entry.LastHeard = time.Now()
+			}
+			oldId := entry.Id
+			entry.Id = newId
+			broadcasts.Queue(entry.Id)
+			// Only a new incarnation with the same state isn't worth recording
+			if reason != "" {
+				recordTransition(oldId, entry.Id, relayer, reason)
+			} else {
+				publishTransition(oldId, entry.Id)
+			}
 		}
 
-		ml.Servers[servNum].Mutex.Unlock()
+		entry.Mutex.Unlock()
 
-		for i:=0; i<=10; i++ {
-			MemList.Servers[i].Mutex.Lock()
-			memLists.NewList = append(memLists.NewList, !(MemList.Servers[i].Id.Failed))
-			MemList.Servers[i].Mutex.Unlock()
+		if update == true {
+			ml.markChanged()
 		}
+	}
+}
+
+// Remembers that the finger table needs rebuilding
+func (ml *MembershipList) markChanged() {
+	ml.UpdateFTMutex.Lock()
+	ml.UpdateFT = true
+	ml.UpdateFTMutex.Unlock()
+}
 
-		shared.GlobalMembershipChannel <- memLists
+// Marks suspected servers as failed once they have been suspected for longer than the suspicion timeout
+func checkSuspicions() {
+	for {
+		time.Sleep(suspicionCheckInterval)
+
+		for _, servNum := range MemList.ServerNumbers() {
+			entry := MemList.Get(servNum)
+			if entry == nil {
+				continue
+			}
 
-		ml.UpdateFTMutex.Lock()
-		ml.UpdateFT = true
-		ml.UpdateFTMutex.Unlock()
+			entry.Mutex.Lock()
+			timedOut := entry.Id.State == Suspect && time.Since(entry.StateChanged) > shared.Config.Failure.SuspicionTimeout.Duration
+			if timedOut {
+				entry.setState(Failed, fmt.Sprintf("suspected for longer than %v", shared.Config.Failure.SuspicionTimeout.Duration))
+				fileLog.Printf("Server %d was suspected for too long, marking it failed\n", servNum)
+			}
+			entry.Mutex.Unlock()
+
+			if timedOut {
+				MemList.markChanged()
+			}
+		}
 	}
 }
 
-// Updates the finger table from the membership list
+// Updates the finger table from the membership list.
+// Servers are arranged in a ring by number, and entry i is the first online server at least 2^i places after us.
 func (ft *FingerTable) Update() {
 	// Set the bool to unchanged
 	MemList.UpdateFTMutex.Lock()
 	MemList.UpdateFT = false
 	MemList.UpdateFTMutex.Unlock()
 
-	self := ownServerNum
+	ring := MemList.ServerNumbers()
+	self := sort.SearchInts(ring, ownServerNum)
 	powerOfTwo := 1
 
 	addedServers := map[int]bool{}
 
 	for i := 0; i < shared.FingerTableSize; i++ {
-		// Find starting point of the search
-		start := (self-1+powerOfTwo)%shared.NumServers + 1
-		look := start
-
 		// Set finger table entry to invalid
 		ft.Entries[i].Number = 0
 		ft.Entries[i].Hostname = ""
 
+		if len(ring) == 0 {
+			continue
+		}
+
+		// Find starting point of the search
+		start := (self + powerOfTwo) % len(ring)
+		look := start
+
 		// Find first server after start that hasn't already been added
 		// 'cont' ensures that the loop is executed at least once
 		for cont := true; cont || look != start; cont = false {
-			// Check if server is online
-			MemList.Servers[look].Mutex.Lock()
-			isOnline := !MemList.Servers[look].Id.Failed && !MemList.Servers[look].Id.TimeStamp.IsZero()
-			MemList.Servers[look].Mutex.Unlock()
+			servNum := ring[look]
 
 			// Add server if not yourself, online, and not in another finger table entry
-			if self != look && isOnline && !addedServers[look] {
-				ft.Entries[i].Number = look
-				ft.Entries[i].Hostname = shared.GetServerAddressFromNumber(look)
+			if servNum != ownServerNum && MemList.IsAlive(servNum) && !addedServers[servNum] {
+				ft.Entries[i].Number = servNum
+				ft.Entries[i].Hostname = shared.GetServerAddressFromNumber(servNum)
 
-				addedServers[look] = true
+				addedServers[servNum] = true
 				break
 			}
 
-			// Increment server number and take modulo
-			look = (look % shared.NumServers) + 1
+			// Move to the next server in the ring
+			look = (look + 1) % len(ring)
 		}
 
 		powerOfTwo *= 2
 	}
 }
 
-func IamIntroducer() bool {
-	return ownServerNum == Introducer.Number
-}
+// Returns the servers in the finger table, after bringing it up to date
+func fingerTargets() (targets []int) {
+	// Update finger table only if membership list changed
+	// TODO don't call finger tables every time
+	//MemList.UpdateFTMutex.Lock()
+	//hasChanged := MemList.UpdateFT
+	//MemList.UpdateFTMutex.Unlock()
+	//if hasChanged == true {
+	//fingerTable.Update()
+	//}
+	fingerTable.Update()
 
-func Join() {
-	// Add yourself to your membership table
-	servNum := ownServerNum
-	MemList.Servers[servNum].Mutex.Lock()
-	MemList.Servers[servNum].Id.ServNum = uint8(servNum)
-	MemList.Servers[servNum].Id.TimeStamp = time.Now()
-	MemList.Servers[servNum].Changed = true
-	MemList.Servers[servNum].Mutex.Unlock()
+	for _, server := range fingerTable.Entries {
+		if server.Number == 0 {
+			break
+		}
+		targets = append(targets, server.Number)
+	}
+	return
+}
 
-	MemList.UpdateFTMutex.Lock()
-	MemList.UpdateFT = true
-	MemList.UpdateFTMutex.Unlock()
+// Every round, pings the servers picked by pickTargets
+func PingIntervalFunction(pickTargets func() []int) {
+	for {
+		SendPingAndMembershipList(pickTargets())
+		interval := nextPingInterval()
+		sleepStart := time.Now()
+		time.Sleep(interval)
+		checkRoundDelay(sleepStart, interval)
+	}
+}
 
-	fileLog.Printf("Server %d joining the network\n", servNum)
+// Send the membership list to the targets
+func SendPingAndMembershipList(targets []int) {
+	if shared.PrintFailDetectInfo {
+		println("Mem list: " + MemList.Str(true))
+	}
 
-	if !IamIntroducer() {
-		// Contact the introducer
-		conn, pingErr := net.Dial("udp", fmt.Sprintf("%s:%d", Introducer.Hostname, shared.SwimIntroducerPort))
-		if pingErr != nil {
-			log.Panic("Introducer ping error: ", pingErr)
+	for _, target := range targets {
+		// Every ping carries its own set of updates, so each one counts as a transmission
+		changedML := broadcasts.Next(shared.Config.Failure.MaxPiggyback)
+		if len(changedML) != 0 && shared.PrintFailDetectInfo {
+			fmt.Printf("ChangedML is %v\n", changedML)
 		}
-		defer conn.Close()
-		// Just ping the introducer, it will send the mem list back on the same connection
-		conn.Write([]byte(""))
-	} else {
-		// Start ping interval for introducer
-		go PingIntervalFunction()
+
+		sentAt := markPingSent(target)
+		timeout := stretch(ackTimeout(target))
+		sendMessage(target, pingPort, Message{Type: PingMsg, Sender: ownServerNum, Ids: changedML})
+
+		// If the ACK doesn't come back in time, ask other servers to try,
+		// and if none of them get an ACK either then suspect it
+		go func(servNum int) {
+			time.Sleep(timeout)
+			if ackedSince(servNum, sentAt) {
+				return
+			}
+			if shared.PrintFailDetectInfo {
+				fmt.Printf("No ACK from server %d, probing it indirectly\n", servNum)
+			}
+			probeIndirectly(servNum)
+
+			// The helpers' round trips to the target come on top of ours to the helpers
+			time.Sleep(stretch(shared.Config.Failure.MaxACKTimeout.Duration))
+			target := MemList.Get(servNum)
+			if target == nil {
+				return
+			}
+			target.Mutex.Lock()
+			if !target.LastACK.After(sentAt) {
+				health.raise(fmt.Sprintf("nobody got an ACK from server %d", servNum))
+			}
+			if !target.LastACK.After(sentAt) && target.Id.State == Alive {
+				target.setState(Suspect, "no ACK, even through other servers")
+				fileLog.Printf("I suspect server %d has failed\n", servNum)
+			}
+			target.Mutex.Unlock()
+		}(target)
 	}
 }
 
-// Leave the group by
-func LeaveGroup() {
-	// Set your own membership entry to failed
-	servNum := ownServerNum
+// Returns whether the server has ACKed us since the given time
+func ackedSince(servNum int, since time.Time) bool {
+	entry := MemList.Get(servNum)
+	if entry == nil {
+		return false
+	}
+	entry.Mutex.Lock()
+	defer entry.Mutex.Unlock()
+	return entry.LastACK.After(since)
+}
+
+// Asks up to IndirectProbes random alive servers to ping the target for us.
+// Their ACKs are forwarded to our ACK port, so they look like an ACK from the target.
+func probeIndirectly(servNum int) {
+	var helpers []int
+	for _, helper := range MemList.AliveServers() {
+		if helper != ownServerNum && helper != servNum {
+			helpers = append(helpers, helper)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > shared.IndirectProbes {
+		helpers = helpers[:shared.IndirectProbes]
+	}
 
-	MemList.Servers[servNum].Mutex.Lock()
-	MemList.Servers[servNum].markFailed()
-	MemList.Servers[servNum].Mutex.Unlock()
+	for _, helper := range helpers {
+		sendMessage(helper, pingPort, Message{Type: PingReqMsg, Sender: ownServerNum, Target: servNum})
+	}
+}
 
-	MemList.UpdateFTMutex.Lock()
-	MemList.UpdateFT = true
-	MemList.UpdateFTMutex.Unlock()
+// Pings the target on behalf of the requester, remembering to forward the target's ACK
+func pingForRequester(requester, target int) {
+	request := &indirectRequest{requester: requester}
+	indirectMutex.Lock()
+	indirectRequests[target] = append(indirectRequests[target], request)
+	indirectMutex.Unlock()
+
+	sendMessage(target, pingPort, Message{Type: PingMsg, Sender: ownServerNum})
+
+	// Give up on forwarding if the target doesn't answer in time
+	time.AfterFunc(stretch(ackTimeout(target)), func() {
+		indirectMutex.Lock()
+		defer indirectMutex.Unlock()
+		requests := indirectRequests[target]
+		for i, pending := range requests {
+			if pending == request {
+				requests = append(requests[:i:i], requests[i+1:]...)
+				break
+			}
+		}
+		if len(requests) == 0 {
+			delete(indirectRequests, target)
+		} else {
+			indirectRequests[target] = requests
+		}
+	})
+}
 
-	// Ping your children
-	SendPingAndMembershipList()
+// Passes on an ACK from the target to everyone who asked us to ping it
+func forwardIndirectACK(target int) {
+	indirectMutex.Lock()
+	requests := indirectRequests[target]
+	delete(indirectRequests, target)
+	indirectMutex.Unlock()
 
-	// Stop your own process
-	fileLog.Printf("Leaving the failure detector peacefully. Goodbye!")
-	log.Println("Ending process normally")
-	os.Exit(0)
+	for _, request := range requests {
+		sendMessage(request.requester, ackPort, Message{Type: ACKMsg, Sender: ownServerNum, Target: target})
+	}
 }
 
-func PingIntervalFunction() {
-	for {
-		SendPingAndMembershipList()
-		time.Sleep(shared.PingInterval)
+// Sends the message to the port picked out by portOf on the given server
+func sendMessage(servNum int, portOf func(shared.Ports) int, msg Message) {
+	packets, encodeErr := msg.Encode()
+	if encodeErr != nil {
+		fileLog.Printf("Couldn't send to server %d: %v\n", servNum, encodeErr)
+		return
+	}
+
+	for _, packet := range packets {
+		packet := packet
+		shared.SendWithFaults(servNum, func() { writePacket(servNum, portOf, msg.Type, signPacket(packet)) })
 	}
 }
 
-// Send the membership list to children
-func SendPingAndMembershipList() {
-	// Update finger table only if membership list changed
-	// TODO don't call finger tables every time
-	//MemList.UpdateFTMutex.Lock()
-	//hasChanged := MemList.UpdateFT
-	//MemList.UpdateFTMutex.Unlock()
-	//if hasChanged == true {
-	//fingerTable.Update()
-	//}
-	fingerTable.Update()
+// Sends the message right away, even if a delay rule is set
+func sendMessageNow(servNum int, portOf func(shared.Ports) int, msg Message) {
+	packets, encodeErr := msg.Encode()
+	if encodeErr != nil {
+		fileLog.Printf("Couldn't send to server %d: %v\n", servNum, encodeErr)
+		return
+	}
+	for _, packet := range packets {
+		shared.SendNowWithFaults(servNum, func() { writePacket(servNum, portOf, msg.Type, signPacket(packet)) })
+	}
+}
 
-	changedML := MemList.GetChanged(false)
-	if shared.PrintFailDetectInfo {
-		println("Mem list: " + MemList.Str(true))
+func writePacket(servNum int, portOf func(shared.Ports) int, msgType MessageType, packet []byte) {
+	conn, dialErr := net.Dial("udp", serverEndpoint(servNum, portOf))
+	if dialErr != nil {
+		fileLog.Printf("Couldn't send to server %d: %v\n", servNum, dialErr)
+		return
 	}
-	if len(changedML) != 0 && shared.PrintFailDetectInfo {
-		fmt.Printf("ChangedML is %v\n", changedML)
+	defer conn.Close()
+	if written, _ := conn.Write(packet); written > 0 {
+		shared.CountTraffic(msgType.String(), servNum, true, written)
 	}
+}
 
-	// pingTargets := fingerTable.Entries
-	for i, server := range fingerTable.Entries {
-		if server.Number == 0 {
-			break
+// Reads and decodes the next message, returning an error only if the connection itself failed.
+// Packets that aren't valid messages are logged and skipped.
+func receiveMessage(conn *net.UDPConn, portName string) (msg Message, senderAddr *net.UDPAddr, err error) {
+	var buf [receiveBufferSize]byte
+	for {
+		var udpLen int
+		udpLen, senderAddr, err = conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return
 		}
-
-		// Unmark this server as received an ACK from it
-		MemList.Servers[server.Number].Mutex.Lock()
-		MemList.Servers[server.Number].ReceivedACK = false
-		MemList.Servers[server.Number].Mutex.Unlock()
-
-		conn, pingErr := net.Dial("udp", fmt.Sprintf("%s:%d", server.Hostname, shared.SwimPingPort))
-		if pingErr != nil {
-			log.Panic("SendPingAndMembershipList ping error: ", pingErr)
+		var decodeErr error
+		msg, decodeErr = DecodeMessage(buf[:udpLen])
+		if decodeErr != nil {
+			shared.CountTraffic(shared.InvalidTraffic, shared.UnknownPeer, false, udpLen)
+			fileLog.Printf("Ignoring bad packet on %s port from %v: %v\n", portName, senderAddr, decodeErr)
+			continue
 		}
-		defer conn.Close()
-
-		changedMLJSON, _ := json.Marshal(changedML)
-
-		conn.Write(changedMLJSON)
-		// If the ACK doesn't come back in time, then mark as failed
-		go func(ii int) {
-			time.Sleep(shared.ACKTimeout)
-			MemList.Servers[fingerTable.Entries[ii].Number].Mutex.Lock()
-			if !MemList.Servers[fingerTable.Entries[ii].Number].ReceivedACK {
-				MemList.Servers[fingerTable.Entries[ii].Number].markFailed()
-				fileLog.Printf("I detected server %d has failed\n", fingerTable.Entries[ii].Number)
-			}
-			MemList.Servers[fingerTable.Entries[ii].Number].Mutex.Unlock()
-		}(i)
+		shared.CountTraffic(msg.Type.String(), msg.Sender, false, udpLen)
+		if shared.GetNode(msg.Sender) == nil {
+			fileLog.Printf("Ignoring %v from unknown server %d at %v\n", msg.Type, msg.Sender, senderAddr)
+			continue
+		}
+		if shared.IsPartitioned(msg.Sender) {
+			continue
+		}
+		if replayErr := checkReplay(msg); replayErr != nil {
+			fileLog.Printf("Ignoring packet on %s port from %v: %v\n", portName, senderAddr, replayErr)
+			continue
+		}
+		return
 	}
 }
 
 // Opens the port so that this machine can be pinged by others
 func OpenPortForPing() {
 	addr := net.UDPAddr{
-		Port: shared.SwimPingPort,
+		Port: shared.OwnNode().Ports.Ping,
 	}
 	conn, udpErr := net.ListenUDP("udp", &addr)
 	if udpErr != nil {
@@ -348,41 +687,75 @@ func OpenPortForPing() {
 
 	go func() {
 		for {
-			var buf [memListBufferSize]byte
-			udpLen, senderAddr, readUDPErr := conn.ReadFromUDP(buf[:])
+			ping, senderAddr, readUDPErr := receiveMessage(conn, "ping")
 			if readUDPErr != nil {
 				log.Panic("OpenPortForPing read udp error: ", readUDPErr)
 			}
 			// fmt.Printf("Received ping from %v\n", senderAddr)
+			if ping.Type != PingMsg && ping.Type != PingReqMsg && ping.Type != HeartbeatMsg {
+				fileLog.Printf("Ignoring %v on the ping port from server %d\n", ping.Type, ping.Sender)
+				continue
+			}
 
 			go func() {
-				// Decode a struct sent over the network
-				var memIds []MembershipId
-				// println("Got a message on the ping port")
-				_ = json.Unmarshal(buf[:udpLen], &memIds)
-				if len(memIds) != 0 && shared.PrintFailDetectInfo {
-					fmt.Printf("Message is %+v\n", memIds)
+				if len(ping.Ids) != 0 && shared.PrintFailDetectInfo {
+					fmt.Printf("Message is %+v\n", ping.Ids)
 				}
-				MemList.Update(memIds)
+				MemList.Update(ping.Ids, ping.Sender)
+				tellServerIfSuspected(ping.Sender)
 			}()
-			go SendACK(conn, senderAddr)
+			// Heartbeats don't get ACKed, the next heartbeat is what shows we're alive
+			if ping.Type == HeartbeatMsg {
+				continue
+			}
+			if ping.Type == PingReqMsg && shared.GetNode(ping.Target) != nil {
+				go pingForRequester(ping.Sender, ping.Target)
+			}
+			go SendACK(conn, senderAddr, ping.Sender)
 		}
 	}()
 }
 
-func SendACK(conn *net.UDPConn, addr *net.UDPAddr) {
-	addr.Port = shared.SwimACKPort
-	// TODO: Send failed to machine that is in current membership list as failed
-	_, err := conn.WriteToUDP([]byte(strconv.Itoa(ownServerNum)), addr)
-	if err != nil {
-		fmt.Printf("Couldn't send ACK %v", err)
+// Nobody pings a server once it is marked failed, so if it pings us we let it know
+// it was suspected or marked failed, and it can refute that if it is actually alive
+func tellServerIfSuspected(servNum int) {
+	failedId, buried := MemList.Buried(servNum)
+	if entry := MemList.Get(servNum); entry != nil {
+		entry.Mutex.Lock()
+		failedId = entry.Id
+		entry.Mutex.Unlock()
+	} else if !buried {
+		return
 	}
+	if failedId.State != Suspect && failedId.State != Failed {
+		return
+	}
+
+	sendMessage(servNum, pingPort, Message{Type: PingMsg, Sender: ownServerNum, Ids: []MembershipId{failedId}})
+}
+
+func SendACK(conn *net.UDPConn, addr *net.UDPAddr, sender int) {
+	addr.Port = shared.GetNode(sender).Ports.ACK
+	ack := Message{Type: ACKMsg, Sender: ownServerNum, Target: ownServerNum}
+	packets, encodeErr := ack.Encode()
+	if encodeErr != nil {
+		fileLog.Printf("Couldn't send an ACK to server %d: %v\n", sender, encodeErr)
+		return
+	}
+	shared.SendWithFaults(sender, func() {
+		written, err := conn.WriteToUDP(signPacket(packets[0]), addr)
+		if err != nil {
+			fmt.Printf("Couldn't send ACK %v", err)
+			return
+		}
+		shared.CountTraffic(ACKMsg.String(), sender, true, written)
+	})
 }
 
 // Opens the port so that this machine can receive acknowlegements from pings
 func OpenPortForACK() {
 	addr := net.UDPAddr{
-		Port: shared.SwimACKPort,
+		Port: shared.OwnNode().Ports.ACK,
 	}
 	conn, udpErr := net.ListenUDP("udp", &addr)
 	if udpErr != nil {
@@ -391,38 +764,44 @@ func OpenPortForACK() {
 
 	go func() {
 		for {
-			var buf [16]byte
-			ackLen, _, readUDPErr := conn.ReadFromUDP(buf[:])
+			ack, _, readUDPErr := receiveMessage(conn, "ACK")
 			if readUDPErr != nil {
 				log.Panic("OpenPortForACK read udp error: ", readUDPErr)
 			}
+			if ack.Type != ACKMsg {
+				fileLog.Printf("Ignoring %v on the ACK port from server %d\n", ack.Type, ack.Sender)
+				continue
+			}
 
 			go func() {
-				str_buf := string(buf[:ackLen])
-				if str_buf == "Failed" {
-					MemList.Servers[fingerTable.Entries[ownServerNum].Number].Mutex.Lock()
-					if !MemList.Servers[fingerTable.Entries[ownServerNum].Number].ReceivedACK {
-						MemList.Servers[fingerTable.Entries[ownServerNum].Number].markFailed()
-						fileLog.Printf("I detected server %d has failed\n", fingerTable.Entries[ownServerNum].Number)
-					}
-					MemList.Servers[fingerTable.Entries[ownServerNum].Number].Mutex.Unlock()
-				}
-				servNum, _ := strconv.Atoi(str_buf)
+				// Relayed ACKs come from the helper, but vouch for the target
+				servNum := ack.Target
 				if shared.PrintFailDetectInfo {
 					fmt.Printf("Received ACK from server %d\n", servNum)
 				}
 
-				MemList.Servers[servNum].Mutex.Lock()
-				MemList.Servers[servNum].ReceivedACK = true
-				MemList.Servers[servNum].Mutex.Unlock()
+				acker := MemList.Get(servNum)
+				if acker == nil {
+					return
+				}
+				acker.Mutex.Lock()
+				acker.recordACK(time.Now())
+				if ack.Sender == servNum && acker.recordRTT(time.Now()) {
+					health.lower()
+				}
+				acker.Mutex.Unlock()
+
+				forwardIndirectACK(servNum)
 			}()
 		}
 	}()
 }
 
+// Opens the port join requests and replies, and whole membership lists to merge, arrive on.
+// Once we have joined, we answer join requests from anyone.
 func OpenPortForIntroducer() {
 	addr := net.UDPAddr{
-		Port: shared.SwimIntroducerPort,
+		Port: shared.OwnNode().Ports.Introducer,
 	}
 	introducerCon, udpErr := net.ListenUDP("udp", &addr)
 	if udpErr != nil {
@@ -434,40 +813,36 @@ func OpenPortForIntroducer() {
 	}
 	go func() {
 		for {
-			var buf [memListBufferSize]byte
-			if !IamIntroducer() {
-				introducerCon.SetReadDeadline(time.Now().Add(shared.IntroducerTimeout))
-			}
-			udpLen, senderAddr, readUDPErr := introducerCon.ReadFromUDP(buf[:])
+			msg, senderAddr, readUDPErr := receiveMessage(introducerCon, "introducer")
 			if readUDPErr != nil {
 				log.Panic("OpenPortForIntroducer ReadUDP error: ", readUDPErr)
 			}
 
-			if IamIntroducer() {
-				if shared.PrintFailDetectInfo {
-					println("I'm the introducer! I'll send my membership list to the pingy boi")
+			switch msg.Type {
+			case JoinMsg:
+				if !HasJoined() {
+					fileLog.Printf("Ignoring join request from server %d, I haven't joined the group myself\n", msg.Sender)
+					continue
 				}
-				go func() {
-					fullMemList := MemList.GetChanged(true)
-					jsonList, _ := json.Marshal(fullMemList)
-					introducerCon.Write(jsonList)
-					senderAddr.Port = shared.SwimIntroducerPort
-					_, _ = introducerCon.WriteToUDP(jsonList, senderAddr)
-				}()
-			} else {
-				if shared.PrintFailDetectInfo {
-					println("I'm the pingy boi, and I got the membership list from the introducer")
-					fmt.Printf("Length of this message was %d bytes\n", udpLen)
+				go answerJoin(introducerCon, senderAddr, msg)
+			case JoinReplyMsg:
+				select {
+				case joinReplies <- msg:
+				default:
+					// Nobody is waiting for it
+				}
+			case MergeMsg:
+				if !HasJoined() {
+					continue
 				}
 				go func() {
-					var memIds []MembershipId
-					_ = json.Unmarshal(buf[:udpLen], &memIds)
-					MemList.Update(memIds)
-					go PingIntervalFunction()
+					MemList.Merge(msg.Ids, msg.Sender)
+					sendMessage(msg.Sender, introducerPort, Message{Type: MergeReplyMsg, Sender: ownServerNum, Ids: Detector.Members()})
 				}()
-				// Close the connection, because the requester will never need to get the mem list again
-				introducerCon.Close()
-				return
+			case MergeReplyMsg:
+				go MemList.Merge(msg.Ids, msg.Sender)
+			default:
+				fileLog.Printf("Ignoring %v on the introducer port from server %d\n", msg.Type, msg.Sender)
 			}
 		}
 	}()
@@ -477,19 +852,20 @@ func Initialize() {
 	if shared.PrintFailDetectInfo {
 		println("Initializing failure detector")
 	}
-	if !IamIntroducer() {
-		time.Sleep(200 * time.Millisecond)
+	ownServerNum = shared.GetOwnServerNumber()
+	fileLog = shared.OpenLogFile(fmt.Sprintf("detectFail%d.log", ownServerNum))
+	if shared.Config.ClusterKey == "" {
+		fileLog.Printf("Running with -insecure and no ClusterKey, anyone who can reach our ports can forge membership messages\n")
 	}
-
-	for i, _ := range MemList.Servers {
-		if i != ownServerNum {
-			MemList.Servers[i].Id.Failed = true
-		}
+	loadSnapshot()
+	startHistory()
+	rpc.Register(new(Membership))
+	detector, detectorErr := newDetector(shared.Config.Failure.Detector, shared.Config.Failure.Probing)
+	if detectorErr != nil {
+		log.Fatal(detectorErr)
 	}
-
-	OpenPortForPing()
-	OpenPortForACK()
-	OpenPortForIntroducer()
+	Detector = detector
+	Detector.Start()
 	if shared.PrintFailDetectInfo {
 		println("Finished initializing failure detector")
 	}
@@ -497,8 +873,5 @@ func Initialize() {
 	if shared.PrintFailDetectInfo {
 		println("Joining group")
 	}
-	Join()
-	if shared.PrintFailDetectInfo {
-		println("Successfully joined group")
-	}
+	Detector.Join()
 }
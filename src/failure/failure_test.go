@@ -0,0 +1,121 @@
+package failure
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"shared"
+)
+
+// Every test runs as server 1 of a local cluster of 10, with a cluster key to sign packets with,
+// and throws the log away
+func TestMain(m *testing.M) {
+	config := shared.LocalConfig(10, 7000)
+	config.ClusterKey = "test key"
+	if configErr := shared.SetConfig(config); configErr != nil {
+		panic(configErr)
+	}
+	ownServerNum = 1
+	fileLog = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// Replaces the membership list with the given servers, each in its own run, and starts out healthy
+func setMembers(states map[int]MemberState) {
+	health.mutex.Lock()
+	health.score = 0
+	health.mutex.Unlock()
+
+	MemList.ServersMutex.Lock()
+	defer MemList.ServersMutex.Unlock()
+	MemList.Servers = map[int]*MembershipEntry{}
+	MemList.Graveyard = map[int]MembershipId{}
+	for servNum, state := range states {
+		id := MembershipId{TimeStamp: time.Unix(int64(servNum), 0), ServNum: servNum, State: state}
+		MemList.Servers[servNum] = &MembershipEntry{Id: id}
+	}
+}
+
+// Returns the update queued for piggybacking about the server, if any
+func queuedUpdate(servNum int) (id MembershipId, ok bool) {
+	broadcasts.mutex.Lock()
+	defer broadcasts.mutex.Unlock()
+	if update, queued := broadcasts.updates[servNum]; queued {
+		return update.id, true
+	}
+	return id, false
+}
+
+func TestUpdateIncarnationOrder(t *testing.T) {
+	run := time.Unix(2, 0)
+	tests := []struct {
+		name string
+		// Server 2's id before and after the update
+		before, update, want MembershipId
+	}{
+		{"higher incarnation wins",
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Suspect},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 2, State: Alive},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 2, State: Alive}},
+		{"same incarnation, suspect beats alive",
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Alive},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Suspect},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Suspect}},
+		{"same incarnation, alive doesn't beat suspect",
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Suspect},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Alive},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Suspect}},
+		{"lower incarnation is ignored",
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 2, State: Alive},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 1, State: Failed},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 2, State: Alive}},
+		{"earlier run is ignored",
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 0, State: Alive},
+			MembershipId{TimeStamp: run.Add(-time.Second), ServNum: 2, Incarnation: 5, State: Failed},
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 0, State: Alive}},
+		{"new run starts over",
+			MembershipId{TimeStamp: run, ServNum: 2, Incarnation: 3, State: Failed},
+			MembershipId{TimeStamp: run.Add(time.Second), ServNum: 2, Incarnation: 0, State: Alive},
+			MembershipId{TimeStamp: run.Add(time.Second), ServNum: 2, Incarnation: 0, State: Alive}},
+	}
+	for _, test := range tests {
+		setMembers(map[int]MemberState{1: Alive, 2: Alive})
+		MemList.Get(2).Id = test.before
+		MemList.Update([]MembershipId{test.update}, 3)
+		if got := MemList.Get(2).Id; !sameId(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUpdateRefutesReportsAboutUs(t *testing.T) {
+	run := time.Unix(1, 0)
+	tests := []struct {
+		name            string
+		report          MembershipId
+		wantIncarnation uint64
+	}{
+		{"suspected at our incarnation", MembershipId{TimeStamp: run, ServNum: 1, Incarnation: 3, State: Suspect}, 4},
+		{"failed at a higher incarnation", MembershipId{TimeStamp: run, ServNum: 1, Incarnation: 5, State: Failed}, 6},
+		{"suspected at an old incarnation", MembershipId{TimeStamp: run, ServNum: 1, Incarnation: 2, State: Suspect}, 3},
+		{"alive at our incarnation", MembershipId{TimeStamp: run, ServNum: 1, Incarnation: 3, State: Alive}, 3},
+	}
+	for _, test := range tests {
+		setMembers(map[int]MemberState{1: Alive, 2: Alive})
+		MemList.Get(1).Id.Incarnation = 3
+		broadcasts = broadcastQueue{updates: map[int]*broadcast{}}
+
+		MemList.Update([]MembershipId{test.report}, 2)
+		self := MemList.Get(1).Id
+		if self.State != Alive || self.Incarnation != test.wantIncarnation {
+			t.Errorf("%s: we are %v at incarnation %d, want Alive at %d", test.name, self.State, self.Incarnation, test.wantIncarnation)
+		}
+		queued, ok := queuedUpdate(1)
+		if refuted := test.wantIncarnation != 3; refuted != (ok && queued.Incarnation == test.wantIncarnation) {
+			t.Errorf("%s: queued refutation %+v (queued %v), want one: %v", test.name, queued, ok, refuted)
+		}
+	}
+}
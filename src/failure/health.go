@@ -0,0 +1,82 @@
+package failure
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// A server that is starved of CPU or has a bad network connection sees ACKs and heartbeats
+// arrive late, and blames the other servers for it. Like Lifeguard, we keep a local health
+// score between 0 and MaxLocalHealth that goes up whenever we see signs that the problem is
+// on our side: a probe nobody could get an ACK for, having to refute that we failed, or one of
+// our own rounds running late. Every timely ACK brings it back down, or with the heartbeat
+// detectors, which don't get ACKs, every round that starts on time. Our timeouts and ping
+// interval are stretched by score+1, so an unhealthy server waits longer before suspecting
+// anyone. See "Lifeguard: Local Health Awareness for More Accurate Failure
+// Detection" by Dadgar et al.
+
+type localHealth struct {
+	score int
+	// Why the score last went up, and when
+	lastReason string
+	lastRaised time.Time
+	mutex      sync.Mutex
+}
+
+var health localHealth
+
+// Raises the score, since something suggests we are the unhealthy one
+func (h *localHealth) raise(reason string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastReason = reason
+	h.lastRaised = time.Now()
+	if h.score < shared.Config.Failure.MaxLocalHealth {
+		h.score++
+		fileLog.Printf("Local health score went up to %d: %s\n", h.score, reason)
+	}
+}
+
+// Lowers the score, since something went as expected
+func (h *localHealth) lower() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.score > 0 {
+		h.score--
+	}
+}
+
+// Returns our local health score, 0 being healthy
+func HealthScore() int {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	return health.score
+}
+
+// Returns the timeout stretched by our local health
+func stretch(timeout time.Duration) time.Duration {
+	return timeout * time.Duration(HealthScore()+1)
+}
+
+// Raises the score if a round started much later than planned, and returns whether it was on time
+func checkRoundDelay(roundStart time.Time, planned time.Duration) bool {
+	if late := time.Since(roundStart) - planned; late > planned {
+		health.raise(fmt.Sprintf("a round started %v late", late.Round(time.Millisecond)))
+		return false
+	}
+	return true
+}
+
+// Returns the local health score, how much our timeouts are stretched, and why it last went up
+func HealthStr() string {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	ret := fmt.Sprintf("Local health score: %d of %d, timeouts are stretched %dx\n", health.score, shared.Config.Failure.MaxLocalHealth, health.score+1)
+	if !health.lastRaised.IsZero() {
+		ret += fmt.Sprintf("Last went up %v ago: %s\n", time.Since(health.lastRaised).Round(time.Second), health.lastReason)
+	}
+	return ret
+}
@@ -0,0 +1,95 @@
+package failure
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"shared"
+)
+
+// Instead of pinging, every server bumps its own heartbeat each round and sends it out.
+// A server whose heartbeat hasn't gone up within HeartbeatTimeout is suspected.
+// With allToAll every server sends its heartbeat straight to every other server,
+// otherwise it gossips its whole membership list to GossipFanout random servers.
+type heartbeatDetector struct {
+	baseDetector
+	allToAll bool
+}
+
+func (detector *heartbeatDetector) Start() {
+	detector.openPorts()
+	go func() {
+		for {
+			detector.beat()
+			detector.sendHeartbeats()
+			checkHeartbeats()
+			sleepStart := time.Now()
+			time.Sleep(shared.Config.Failure.HeartbeatInterval.Duration)
+			if checkRoundDelay(sleepStart, shared.Config.Failure.HeartbeatInterval.Duration) {
+				health.lower()
+			}
+		}
+	}()
+}
+
+// Bumps our own heartbeat
+func (detector *heartbeatDetector) beat() {
+	self := MemList.Get(ownServerNum)
+	self.Mutex.Lock()
+	self.Id.Heartbeat++
+	self.Mutex.Unlock()
+}
+
+func (detector *heartbeatDetector) sendHeartbeats() {
+	if shared.PrintFailDetectInfo {
+		println("Mem list: " + MemList.Str(true))
+	}
+
+	var targets []int
+	for _, servNum := range MemList.AliveServers() {
+		if servNum != ownServerNum {
+			targets = append(targets, servNum)
+		}
+	}
+	if !detector.allToAll {
+		rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+		if len(targets) > shared.Config.Failure.GossipFanout {
+			targets = targets[:shared.Config.Failure.GossipFanout]
+		}
+	}
+
+	for _, servNum := range targets {
+		// Our own entry always goes first, since it carries the heartbeat
+		self := MemList.Get(ownServerNum)
+		self.Mutex.Lock()
+		ids := []MembershipId{self.Id}
+		self.Mutex.Unlock()
+
+		ids = append(ids, broadcasts.Next(shared.Config.Failure.MaxPiggyback)...)
+		if !detector.allToAll {
+			ids = append(ids, MemList.GetAll()...)
+		}
+		sendMessage(servNum, pingPort, Message{Type: HeartbeatMsg, Sender: ownServerNum, Ids: ids})
+	}
+}
+
+// Suspects every alive server whose heartbeat hasn't gone up in time
+func checkHeartbeats() {
+	for _, servNum := range MemList.ServerNumbers() {
+		if servNum == ownServerNum {
+			continue
+		}
+		entry := MemList.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		entry.Mutex.Lock()
+		if entry.Id.State == Alive && time.Since(entry.LastHeard) > stretch(shared.Config.Failure.HeartbeatTimeout.Duration) {
+			health.raise(fmt.Sprintf("server %d's heartbeat stopped", servNum))
+			entry.setState(Suspect, fmt.Sprintf("heartbeat stuck at %d", entry.Id.Heartbeat))
+			fileLog.Printf("I suspect server %d has failed, its heartbeat is stuck at %d\n", servNum, entry.Id.Heartbeat)
+		}
+		entry.Mutex.Unlock()
+	}
+}
@@ -0,0 +1,258 @@
+package failure
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// Every change in a server's state is recorded along with why it happened and which server passed
+// it on to us. Gathering the history from every server shows who declared whom dead and when: the
+// server that decided on its own relayed the change to itself. The last HistoryLength
+// changes are kept in memory, and every change is appended to membershipHistoryN.log in our log
+// folder as a line of JSON, which is cut back to HistoryLength lines once it gets twice as long.
+// The history is also served over RPC on the grep port, so it can be gathered from every server.
+
+// One change in a server's state, as seen by RecordedBy
+type Transition struct {
+	Time    time.Time
+	ServNum int
+	// Whether we had heard of the server before. If not, OldState means nothing.
+	Known       bool
+	OldState    MemberState
+	NewState    MemberState
+	Incarnation uint64
+	// The server whose message told us about it, or RecordedBy if it decided on its own.
+	// Gossip passes updates along, so this isn't always the server that made the change.
+	Relayer    int
+	RecordedBy int
+	Reason     string
+}
+
+type transitionHistory struct {
+	transitions []Transition
+	// Lines in the history file, to know when to cut it back
+	fileLines int
+	toWrite   chan Transition
+	// Transitions that didn't fit in toWrite, and so never made it to the file
+	dropped int
+	mutex   sync.Mutex
+}
+
+var history = transitionHistory{toWrite: make(chan Transition, 256)}
+
+func historyPath() string {
+	return shared.LogPath(fmt.Sprintf("membershipHistory%d.log", ownServerNum))
+}
+
+// Publishes the change from oldId to newId, and records it in the history
+func recordTransition(oldId, newId MembershipId, relayer int, reason string) {
+	publishTransition(oldId, newId)
+	history.add(Transition{
+		Time:        time.Now(),
+		ServNum:     newId.ServNum,
+		Known:       !oldId.TimeStamp.IsZero(),
+		OldState:    oldId.State,
+		NewState:    newId.State,
+		Incarnation: newId.Incarnation,
+		Relayer:     relayer,
+		RecordedBy:  ownServerNum,
+		Reason:      reason,
+	})
+}
+
+// Called with the entry's lock held, so a slow disk can't be allowed to hold up the membership list
+func (h *transitionHistory) add(transition Transition) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.transitions = append(h.transitions, transition)
+	if len(h.transitions) > shared.Config.Failure.HistoryLength {
+		h.transitions = h.transitions[len(h.transitions)-shared.Config.Failure.HistoryLength:]
+	}
+	select {
+	case h.toWrite <- transition:
+	default:
+		h.dropped++
+		fileLog.Printf("The membership history file is behind, %d changes weren't written to it\n", h.dropped)
+	}
+}
+
+// Returns the recorded transitions about the server, or every transition if servNum is 0
+func (h *transitionHistory) about(servNum int) (transitions []Transition) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, transition := range h.transitions {
+		if servNum == 0 || transition.ServNum == servNum {
+			transitions = append(transitions, transition)
+		}
+	}
+	return
+}
+
+// Loads the history left by our last run, so it survives restarts
+func (h *transitionHistory) load() {
+	historyFile, openErr := os.Open(historyPath())
+	if openErr != nil {
+		return
+	}
+	defer historyFile.Close()
+
+	scanner := bufio.NewScanner(historyFile)
+	for scanner.Scan() {
+		var transition Transition
+		if json.Unmarshal(scanner.Bytes(), &transition) != nil {
+			continue
+		}
+		h.fileLines++
+		h.transitions = append(h.transitions, transition)
+		if len(h.transitions) > shared.Config.Failure.HistoryLength {
+			h.transitions = h.transitions[1:]
+		}
+	}
+}
+
+// Appends every recorded transition to the history file
+func (h *transitionHistory) writeToDisk() {
+	for transition := range h.toWrite {
+		if writeErr := h.appendToFile(transition); writeErr != nil {
+			fileLog.Printf("Couldn't write to the membership history: %v\n", writeErr)
+		}
+	}
+}
+
+func (h *transitionHistory) appendToFile(transition Transition) error {
+	h.mutex.Lock()
+	h.fileLines++
+	tooLong := h.fileLines > 2*shared.Config.Failure.HistoryLength
+	var keep []Transition
+	if tooLong {
+		keep = append(keep, h.transitions...)
+		h.fileLines = len(keep)
+	}
+	h.mutex.Unlock()
+
+	// The transition is already in memory, so rewriting from memory includes it
+	if tooLong {
+		return h.rewriteFile(keep)
+	}
+	historyFile, openErr := os.OpenFile(historyPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if openErr != nil {
+		return openErr
+	}
+	defer historyFile.Close()
+	return json.NewEncoder(historyFile).Encode(transition)
+}
+
+// Replaces the history file with the given transitions all at once
+func (h *transitionHistory) rewriteFile(transitions []Transition) error {
+	tmpPath := historyPath() + ".tmp"
+	tmpFile, createErr := os.Create(tmpPath)
+	if createErr != nil {
+		return createErr
+	}
+	encoder := json.NewEncoder(tmpFile)
+	for _, transition := range transitions {
+		if encodeErr := encoder.Encode(transition); encodeErr != nil {
+			tmpFile.Close()
+			return encodeErr
+		}
+	}
+	if closeErr := tmpFile.Close(); closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmpPath, historyPath())
+}
+
+func (transition *Transition) Str() string {
+	oldState := "unknown"
+	if transition.Known {
+		oldState = transition.OldState.String()
+	}
+	source := "on its own"
+	if transition.Relayer != transition.RecordedBy {
+		source = fmt.Sprintf("relayed by server %d", transition.Relayer)
+	}
+	return fmt.Sprintf("%s  server %d saw server %d go %s -> %s (incarnation %d), %s: %s",
+		transition.Time.Format("2006-01-02 15:04:05.000"), transition.RecordedBy, transition.ServNum,
+		oldState, transition.NewState, transition.Incarnation, source, transition.Reason)
+}
+
+// Returns every transition this server recorded, one per line
+func HistoryStr() (ret string) {
+	for _, transition := range history.about(0) {
+		ret += transition.Str() + "\n"
+	}
+	if ret == "" {
+		ret = "No membership changes recorded\n"
+	}
+	return
+}
+
+type HistoryArgs struct {
+	// The server to get the transitions of, or 0 for every server
+	ServNum int
+}
+
+type HistoryReply struct {
+	Transitions []Transition
+}
+
+func (membership *Membership) History(args *HistoryArgs, reply *HistoryReply) error {
+	reply.Transitions = history.about(args.ServNum)
+	return nil
+}
+
+// Asks every alive server for its transitions about the given server, and returns them all in
+// the order they happened, one per line, followed by any server that couldn't be asked
+func GatherHistoryStr(servNum int) (ret string) {
+	type result struct {
+		server      int
+		transitions []Transition
+		err         error
+	}
+	servers := MemList.AliveServers()
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		go func(server int) {
+			if server == ownServerNum {
+				results <- result{server, history.about(servNum), nil}
+				return
+			}
+			var reply HistoryReply
+			askErr := callMembership(server, "Membership.History", &HistoryArgs{ServNum: servNum}, &reply)
+			results <- result{server, reply.Transitions, askErr}
+		}(server)
+	}
+
+	var transitions []Transition
+	var failures string
+	for range servers {
+		res := <-results
+		if res.err != nil {
+			failures += fmt.Sprintf("Couldn't get the history from server %d: %v\n", res.server, res.err)
+			continue
+		}
+		transitions = append(transitions, res.transitions...)
+	}
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].Time.Before(transitions[j].Time) })
+
+	for _, transition := range transitions {
+		ret += transition.Str() + "\n"
+	}
+	if len(transitions) == 0 {
+		ret = fmt.Sprintf("No server recorded any changes to server %d\n", servNum)
+	}
+	return ret + failures
+}
+
+// Loads the saved history and starts writing new transitions to disk
+func startHistory() {
+	history.load()
+	go history.writeToDisk()
+}
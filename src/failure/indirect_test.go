@@ -0,0 +1,52 @@
+package failure
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns the servers waiting on an ACK from the target
+func waitingOn(target int) (requesters []int) {
+	indirectMutex.Lock()
+	defer indirectMutex.Unlock()
+	for _, request := range indirectRequests[target] {
+		requesters = append(requesters, request.requester)
+	}
+	return
+}
+
+func TestIndirectRequestsTimeOutSeparately(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive, 2: Alive, 3: Alive, 4: Alive})
+	// Gives the target an ACK timeout of 400ms
+	MemList.Get(4).RTTs = []time.Duration{380 * time.Millisecond}
+	if timeout := ackTimeout(4); timeout != 400*time.Millisecond {
+		t.Fatalf("ACK timeout of server 4 is %v, want 400ms", timeout)
+	}
+
+	pingForRequester(2, 4)
+	time.Sleep(200 * time.Millisecond)
+	pingForRequester(3, 4)
+
+	// The first request has timed out, but the second is still waiting
+	time.Sleep(300 * time.Millisecond)
+	if got := waitingOn(4); len(got) != 1 || got[0] != 3 {
+		t.Errorf("after the first request timed out, waiting on server 4: %v, want [3]", got)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if got := waitingOn(4); len(got) != 0 {
+		t.Errorf("after both requests timed out, waiting on server 4: %v, want none", got)
+	}
+}
+
+func TestForwardIndirectACK(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive, 2: Alive, 3: Alive, 4: Alive})
+	pingForRequester(2, 4)
+	pingForRequester(3, 4)
+	if got := waitingOn(4); len(got) != 2 {
+		t.Fatalf("waiting on server 4: %v, want [2 3]", got)
+	}
+	forwardIndirectACK(4)
+	if got := waitingOn(4); len(got) != 0 {
+		t.Errorf("after forwarding the ACK, waiting on server 4: %v, want none", got)
+	}
+}
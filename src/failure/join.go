@@ -0,0 +1,165 @@
+package failure
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"shared"
+)
+
+// New servers join by asking the seed nodes from the cluster config, in order, for the
+// membership list, after any servers that were alive in the snapshot from our last run.
+// Any server that has joined answers, and adds the joiner to its own list.
+// If no seed answers, the joiner waits longer and longer before trying them all again.
+// A seed starts the group on its own once a full pass gets no answer, but later seeds wait a
+// pass longer for each seed ahead of them, so seeds that start at the same time let the first
+// one start the group, and the group still forms if the first ones are down. In case groups
+// still start apart, seeds keep offering to merge with the seeds they haven't heard from, see
+// partition.go.
+
+// Join replies are passed from the introducer port to whoever is waiting on them
+var joinReplies = make(chan Message, maxParts)
+
+// Whether we are part of the group, and can let other servers in
+var joined atomic.Bool
+
+// Returns whether we have joined the group
+func HasJoined() bool {
+	return joined.Load()
+}
+
+// Keeps asking the known peers and seeds to let us in until one of them does
+func joinThroughSeeds() {
+	backoff := shared.JoinRetryBackoff
+	for attempt := 1; ; attempt++ {
+		for _, servNum := range joinCandidates() {
+			if askToJoin(servNum) {
+				fileLog.Printf("Joined the group through server %d\n", servNum)
+				finishJoining()
+				return
+			}
+		}
+
+		if rank := seedRank(ownServerNum); rank >= 0 && attempt > rank {
+			fileLog.Printf("No other seed answered in %d attempts, starting the group myself\n", attempt)
+			finishJoining()
+			return
+		}
+		fileLog.Printf("No seed answered join attempt %d, trying again in %v\n", attempt, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > shared.MaxJoinRetryBackoff {
+			backoff = shared.MaxJoinRetryBackoff
+		}
+	}
+}
+
+// Returns the servers to ask to join, known peers first, without us or any server twice
+func joinCandidates() (candidates []int) {
+	asked := map[int]bool{ownServerNum: true}
+	for _, servNum := range append(append([]int(nil), knownPeers...), shared.Config.Seeds...) {
+		if !asked[servNum] {
+			asked[servNum] = true
+			candidates = append(candidates, servNum)
+		}
+	}
+	return
+}
+
+func finishJoining() {
+	joined.Store(true)
+	if shared.PrintFailDetectInfo {
+		println("Successfully joined group")
+	}
+}
+
+func isSeed(servNum int) bool {
+	return seedRank(servNum) >= 0
+}
+
+// Returns where the server is in the list of seeds, or -1 if it isn't a seed.
+// The seed at rank r starts the group on its own after r+1 join attempts get no answer.
+func seedRank(servNum int) int {
+	for rank, seed := range shared.Config.Seeds {
+		if seed == servNum {
+			return rank
+		}
+	}
+	return -1
+}
+
+// Returns the other seeds we have never heard from
+func unseenSeeds() (unseen []int) {
+	for _, seed := range shared.Config.Seeds {
+		if _, known := MemList.State(seed); !known && seed != ownServerNum {
+			if _, buried := MemList.Buried(seed); !buried {
+				unseen = append(unseen, seed)
+			}
+		}
+	}
+	return
+}
+
+// Sends a join request to the server, and returns whether it sent back the membership list in time.
+// If only some parts of the list come back, gossip will fill in the rest.
+func askToJoin(servNum int) bool {
+	// Throw away late replies to an earlier attempt
+	for len(joinReplies) > 0 {
+		<-joinReplies
+	}
+
+	self := MemList.Get(ownServerNum)
+	self.Mutex.Lock()
+	selfId := self.Id
+	self.Mutex.Unlock()
+	sendMessage(servNum, introducerPort, Message{Type: JoinMsg, Sender: ownServerNum, Ids: []MembershipId{selfId}})
+
+	receivedParts := map[int]bool{}
+	timeout := time.After(shared.IntroducerTimeout)
+	for {
+		select {
+		case reply := <-joinReplies:
+			if reply.Sender != servNum {
+				continue
+			}
+			if shared.PrintFailDetectInfo {
+				fmt.Printf("Got part %d of %d of the membership list from server %d with %d entries\n", reply.Part+1, reply.Parts, servNum, len(reply.Ids))
+			}
+			MemList.Update(reply.Ids, servNum)
+			receivedParts[reply.Part] = true
+			if len(receivedParts) == reply.Parts {
+				return true
+			}
+		case <-timeout:
+			if len(receivedParts) > 0 {
+				fileLog.Printf("Only got %d parts of the membership list from server %d\n", len(receivedParts), servNum)
+				return true
+			}
+			fileLog.Printf("Server %d didn't answer my join request\n", servNum)
+			return false
+		}
+	}
+}
+
+// Adds the joiner to our membership list, and sends it the whole list
+func answerJoin(conn *net.UDPConn, joinerAddr *net.UDPAddr, request Message) {
+	MemList.Update(request.Ids, request.Sender)
+
+	reply := Message{Type: JoinReplyMsg, Sender: ownServerNum, Ids: MemList.GetAll()}
+	packets, encodeErr := reply.Encode()
+	if encodeErr != nil {
+		fileLog.Printf("Couldn't send membership list to server %d: %v\n", request.Sender, encodeErr)
+		return
+	}
+	joinerAddr.Port = shared.GetNode(request.Sender).Ports.Introducer
+	for _, packet := range packets {
+		packet := packet
+		shared.SendWithFaults(request.Sender, func() {
+			if written, _ := conn.WriteToUDP(signPacket(packet), joinerAddr); written > 0 {
+				shared.CountTraffic(JoinReplyMsg.String(), request.Sender, true, written)
+			}
+		})
+	}
+}
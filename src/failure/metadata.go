@@ -0,0 +1,207 @@
+package failure
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// Every server's metadata is kept on its entry in Meta. Only the version goes out with the
+// membership list, in MembershipId.MetaVersion, so packets stay small. When we hear of a newer
+// version than the one we hold, we fetch the metadata from the server itself over RPC. Versions
+// count from 1 in every run of a server, so metadata from an earlier run is dropped when the
+// server rejoins.
+
+// How often to check for metadata we need to fetch
+const metadataFetchInterval = time.Second
+
+// The servers we are fetching metadata from right now
+var metadataFetching = map[int]bool{}
+var metadataFetchingMutex sync.Mutex
+
+// Returns the metadata we start with: where to find us, our version, and whatever the config adds
+func ownMetadata() map[string]string {
+	meta := shared.EndpointMetadata(ownServerNum)
+	meta[shared.MetaSoftwareVersion] = shared.SoftwareVersion
+	for key, value := range shared.OwnNode().Metadata {
+		meta[key] = value
+	}
+	return meta
+}
+
+// Sets one of our metadata keys, or removes it if the value is empty, and tells the other servers
+func SetMetadata(key, value string) error {
+	self := MemList.Get(ownServerNum)
+	if self == nil {
+		return fmt.Errorf("not in the membership list yet")
+	}
+	self.Mutex.Lock()
+	defer self.Mutex.Unlock()
+
+	meta := map[string]string{}
+	for oldKey, oldValue := range self.Meta {
+		meta[oldKey] = oldValue
+	}
+	if value == "" {
+		delete(meta, key)
+	} else {
+		meta[key] = value
+	}
+	if metaErr := shared.CheckMetadata(meta); metaErr != nil {
+		return metaErr
+	}
+	if endpointErr := shared.CheckEndpointMetadata(ownServerNum, meta); endpointErr != nil {
+		return endpointErr
+	}
+
+	self.Meta = meta
+	self.Id.MetaVersion++
+	self.MetaHeld = self.Id.MetaVersion
+	broadcasts.Queue(self.Id)
+	fileLog.Printf("Set metadata %s to %q, now at version %d\n", key, value, self.Id.MetaVersion)
+	return nil
+}
+
+// Returns the server's metadata, or nil if we haven't got it yet. Don't change the map.
+func MetadataOf(servNum int) map[string]string {
+	entry := MemList.Get(servNum)
+	if entry == nil {
+		return nil
+	}
+	entry.Mutex.Lock()
+	defer entry.Mutex.Unlock()
+	return entry.Meta
+}
+
+// Returns the alive servers whose metadata has every key set to the value in filters
+func ServersWithMetadata(filters map[string]string) (servNums []int) {
+	for _, servNum := range MemList.AliveServers() {
+		if shared.MetadataMatches(MetadataOf(servNum), filters) {
+			servNums = append(servNums, servNum)
+		}
+	}
+	return
+}
+
+// Returns the metadata we hold for the server, or for every alive server if servNum is 0
+func (ml *MembershipList) metadata(servNum int) (servers []shared.ServerMetadata) {
+	servNums := []int{servNum}
+	if servNum == 0 {
+		servNums = ml.AliveServers()
+	}
+	for _, servNum := range servNums {
+		entry := ml.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		entry.Mutex.Lock()
+		if entry.MetaHeld > 0 {
+			servers = append(servers, shared.ServerMetadata{ServNum: servNum, Run: entry.Id.TimeStamp, Version: entry.MetaHeld, Meta: entry.Meta})
+		}
+		entry.Mutex.Unlock()
+	}
+	return
+}
+
+func (membership *Membership) Metadata(args *shared.MetadataArgs, reply *shared.MetadataReply) error {
+	reply.Servers = MemList.metadata(args.ServNum)
+	return nil
+}
+
+// Keeps metadata the server sent us about itself, if it is newer than ours and from the same run
+func (ml *MembershipList) storeMetadata(server shared.ServerMetadata) {
+	entry := ml.Get(server.ServNum)
+	if entry == nil || server.ServNum == ownServerNum {
+		return
+	}
+	metaErr := shared.CheckMetadata(server.Meta)
+	if metaErr == nil {
+		metaErr = shared.CheckEndpointMetadata(server.ServNum, server.Meta)
+	}
+	if metaErr != nil {
+		fileLog.Printf("Ignoring the metadata of server %d: %v\n", server.ServNum, metaErr)
+		return
+	}
+	entry.Mutex.Lock()
+	defer entry.Mutex.Unlock()
+	if !server.Run.Equal(entry.Id.TimeStamp) || server.Version <= entry.MetaHeld {
+		return
+	}
+	entry.Meta, entry.MetaHeld = server.Meta, server.Version
+	if server.Version > entry.Id.MetaVersion {
+		entry.Id.MetaVersion = server.Version
+	}
+}
+
+// Every metadataFetchInterval, fetches the metadata of every alive server we only hold an older version for
+func fetchMetadata() {
+	for {
+		time.Sleep(metadataFetchInterval)
+		for _, servNum := range MemList.AliveServers() {
+			entry := MemList.Get(servNum)
+			if servNum == ownServerNum || entry == nil {
+				continue
+			}
+			entry.Mutex.Lock()
+			behind := entry.Id.MetaVersion > entry.MetaHeld
+			entry.Mutex.Unlock()
+
+			metadataFetchingMutex.Lock()
+			if behind && !metadataFetching[servNum] {
+				metadataFetching[servNum] = true
+				go fetchMetadataFrom(servNum)
+			}
+			metadataFetchingMutex.Unlock()
+		}
+	}
+}
+
+// Asks the server for its own metadata
+func fetchMetadataFrom(servNum int) {
+	defer func() {
+		metadataFetchingMutex.Lock()
+		delete(metadataFetching, servNum)
+		metadataFetchingMutex.Unlock()
+	}()
+
+	var reply shared.MetadataReply
+	if callErr := callMembership(servNum, "Membership.Metadata", &shared.MetadataArgs{ServNum: servNum}, &reply); callErr != nil {
+		fileLog.Printf("Couldn't fetch the metadata of server %d: %v\n", servNum, callErr)
+		return
+	}
+	for _, server := range reply.Servers {
+		if server.ServNum == servNum {
+			MemList.storeMetadata(server)
+		}
+	}
+}
+
+// Returns the metadata of the server, or of every alive server if servNum is 0, one server per line
+func MetadataStr(servNum int) (ret string) {
+	servNums := []int{servNum}
+	if servNum == 0 {
+		servNums = MemList.AliveServers()
+	}
+	for _, servNum := range servNums {
+		entry := MemList.Get(servNum)
+		if entry == nil {
+			ret += fmt.Sprintf("Server %d: not in the membership list\n", servNum)
+			continue
+		}
+		entry.Mutex.Lock()
+		meta, held, wanted := entry.Meta, entry.MetaHeld, entry.Id.MetaVersion
+		entry.Mutex.Unlock()
+
+		switch {
+		case held == 0:
+			ret += fmt.Sprintf("Server %d: not fetched yet\n", servNum)
+		case held < wanted:
+			ret += fmt.Sprintf("Server %d (version %d, fetching %d): %s\n", servNum, held, wanted, shared.MetadataStr(meta))
+		default:
+			ret += fmt.Sprintf("Server %d (version %d): %s\n", servNum, held, shared.MetadataStr(meta))
+		}
+	}
+	return
+}
@@ -0,0 +1,31 @@
+package failure
+
+import (
+	"testing"
+	"time"
+
+	"shared"
+)
+
+func TestStoreMetadata(t *testing.T) {
+	run := time.Unix(2, 0)
+	tests := []struct {
+		name     string
+		server   shared.ServerMetadata
+		wantHeld uint64
+	}{
+		{"newer version", shared.ServerMetadata{ServNum: 2, Run: run, Version: 1, Meta: map[string]string{"role": "storage"}}, 1},
+		{"endpoints from the config", shared.ServerMetadata{ServNum: 2, Run: run, Version: 1, Meta: shared.EndpointMetadata(2)}, 1},
+		{"earlier run", shared.ServerMetadata{ServNum: 2, Run: run.Add(-time.Second), Version: 1, Meta: map[string]string{"role": "storage"}}, 0},
+		{"another address", shared.ServerMetadata{ServNum: 2, Run: run, Version: 1, Meta: map[string]string{shared.MetaAddress: "evil.example.com"}}, 0},
+		{"another file port", shared.ServerMetadata{ServNum: 2, Run: run, Version: 1, Meta: map[string]string{shared.MetaFilePort: "1"}}, 0},
+		{"another server's endpoints", shared.ServerMetadata{ServNum: 2, Run: run, Version: 1, Meta: shared.EndpointMetadata(3)}, 0},
+	}
+	for _, test := range tests {
+		setMembers(map[int]MemberState{1: Alive, 2: Alive})
+		MemList.storeMetadata(test.server)
+		if held := MemList.Get(2).MetaHeld; held != test.wantHeld {
+			t.Errorf("%s: holding version %d, want %d", test.name, held, test.wantHeld)
+		}
+	}
+}
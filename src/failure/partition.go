@@ -0,0 +1,154 @@
+package failure
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// When the network splits, each side sees the servers on the other side fail at about the same time.
+// If at least PartitionFraction of the group fails within PartitionWindow, we assume a partition
+// rather than crashes, and remember whether our side is the smaller one. The partition is over
+// as soon as any of the lost servers is reachable again.
+//
+// Nobody pings failed servers, so on their own the two sides would never find each other again.
+// Every MergeInterval we send our whole membership list to a random failed server. If it is
+// actually alive, it merges our list into its own, refutes our claim that it failed, and sends
+// its list back for us to merge, after which normal gossip reconciles everyone else.
+// Seeds also send their list to every seed they have never heard from, so groups that were
+// started apart by seeds that couldn't reach each other come together the same way.
+
+type partitionState struct {
+	suspected bool
+	// How many servers were alive just before the partition
+	groupSize int
+	// The servers we lost in the partition
+	lost  map[int]bool
+	mutex sync.Mutex
+}
+
+var partition = partitionState{lost: map[int]bool{}}
+
+// Returns whether we think the network is split
+func PartitionSuspected() bool {
+	partition.mutex.Lock()
+	defer partition.mutex.Unlock()
+	return partition.suspected
+}
+
+// Returns whether the network is split and we can reach at most half of the group
+func InMinority() bool {
+	partition.mutex.Lock()
+	defer partition.mutex.Unlock()
+	return partition.suspected && 2*len(MemList.AliveServers()) <= partition.groupSize
+}
+
+func watchForPartitions(events <-chan MembershipEvent) {
+	for event := range events {
+		partition.handle(event)
+	}
+}
+
+func (state *partitionState) handle(event MembershipEvent) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	switch event.Type {
+	case FailedEvent:
+		// Events can be coalesced or late, so count the failures from the membership list
+		recentFailures := MemList.FailedSince(time.Now().Add(-shared.Config.Failure.PartitionWindow.Duration))
+		alive := len(MemList.AliveServers())
+		groupSize := alive + len(recentFailures)
+
+		if state.suspected {
+			state.lost[event.ServNum] = true
+			if groupSize > state.groupSize {
+				state.groupSize = groupSize
+			}
+			return
+		}
+		if len(recentFailures) < 2 || float64(len(recentFailures)) < shared.Config.Failure.PartitionFraction*float64(groupSize) {
+			return
+		}
+		state.suspected = true
+		state.groupSize = groupSize
+		state.lost = map[int]bool{}
+		for _, servNum := range recentFailures {
+			state.lost[servNum] = true
+		}
+		fileLog.Printf("Lost %d of %d servers within %v, the network is probably partitioned. In the minority: %v\n",
+			len(recentFailures), groupSize, shared.Config.Failure.PartitionWindow.Duration, 2*alive <= groupSize)
+	case JoinedEvent, RejoinedEvent, RefutedEvent, LeftEvent:
+		if state.suspected && state.lost[event.ServNum] {
+			state.suspected = false
+			state.lost = map[int]bool{}
+			fileLog.Printf("Server %d is back, the partition has healed\n", event.ServNum)
+		}
+	}
+}
+
+// Every MergeInterval, offers to merge membership lists with a random failed server
+func mergeWithFailedServers() {
+	for {
+		time.Sleep(shared.Config.Failure.MergeInterval.Duration)
+		if !HasJoined() {
+			continue
+		}
+
+		// Servers we already forgot are included, with our claim that they failed so they can refute it
+		var failed []int
+		ids := Detector.Members()
+		for _, id := range MemList.Tombstones() {
+			if id.State == Failed {
+				ids = append(ids, id)
+			}
+		}
+		for _, id := range ids {
+			if id.State == Failed {
+				failed = append(failed, id.ServNum)
+			}
+		}
+		if isSeed(ownServerNum) {
+			for _, seed := range unseenSeeds() {
+				sendMessage(seed, introducerPort, Message{Type: MergeMsg, Sender: ownServerNum, Ids: ids})
+			}
+		}
+		if len(failed) == 0 {
+			continue
+		}
+		servNum := failed[rand.Intn(len(failed))]
+		sendMessage(servNum, introducerPort, Message{Type: MergeMsg, Sender: ownServerNum, Ids: ids})
+	}
+}
+
+// Returns the servers that were marked failed after the given time
+func (ml *MembershipList) FailedSince(since time.Time) (failed []int) {
+	for _, servNum := range ml.ServerNumbers() {
+		entry := ml.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		entry.Mutex.Lock()
+		if entry.Id.State == Failed && entry.StateChanged.After(since) {
+			failed = append(failed, servNum)
+		}
+		entry.Mutex.Unlock()
+	}
+	return
+}
+
+// Merges another server's membership list into ours. Unlike Update, it ignores claims that servers
+// we can still reach are suspected or failed, since those come from the other side of a partition.
+// Claims about us are still refuted, and the server we think failed refutes them itself when it hears.
+func (ml *MembershipList) Merge(ids []MembershipId, relayer int) {
+	var accepted []MembershipId
+	for _, id := range ids {
+		if id.ServNum != ownServerNum && (id.State == Suspect || id.State == Failed) && ml.IsAlive(id.ServNum) {
+			continue
+		}
+		accepted = append(accepted, id)
+	}
+	ml.Update(accepted, relayer)
+}
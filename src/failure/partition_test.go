@@ -0,0 +1,93 @@
+package failure
+
+import (
+	"testing"
+	"time"
+)
+
+// Sets up servers 1 to numServers, with the given ones having just failed
+func setFailures(numServers int, failed ...int) {
+	states := map[int]MemberState{}
+	for servNum := 1; servNum <= numServers; servNum++ {
+		states[servNum] = Alive
+	}
+	for _, servNum := range failed {
+		states[servNum] = Failed
+	}
+	setMembers(states)
+	for _, servNum := range failed {
+		MemList.Get(servNum).StateChanged = time.Now()
+	}
+}
+
+func TestPartitionDetection(t *testing.T) {
+	tests := []struct {
+		name         string
+		failed       []int
+		wantSuspect  bool
+		wantMinority bool
+	}{
+		{"one crash", []int{2}, false, false},
+		{"two of ten", []int{2, 3}, false, false},
+		{"four of ten", []int{2, 3, 4, 5}, true, false},
+		{"six of ten", []int{2, 3, 4, 5, 6, 7}, true, true},
+	}
+	for _, test := range tests {
+		setFailures(10, test.failed...)
+		partition = partitionState{lost: map[int]bool{}}
+		for _, servNum := range test.failed {
+			partition.handle(MembershipEvent{Type: FailedEvent, ServNum: servNum})
+		}
+		if got := PartitionSuspected(); got != test.wantSuspect {
+			t.Errorf("%s: partition suspected %v, want %v", test.name, got, test.wantSuspect)
+		}
+		if got := InMinority(); got != test.wantMinority {
+			t.Errorf("%s: in the minority %v, want %v", test.name, got, test.wantMinority)
+		}
+	}
+}
+
+func TestPartitionHeals(t *testing.T) {
+	setFailures(10, 2, 3, 4, 5)
+	partition = partitionState{lost: map[int]bool{}}
+	partition.handle(MembershipEvent{Type: FailedEvent, ServNum: 5})
+	if !PartitionSuspected() {
+		t.Fatal("losing four of ten servers at once wasn't taken for a partition")
+	}
+
+	// A server that wasn't lost in the partition doesn't say anything about it
+	partition.handle(MembershipEvent{Type: JoinedEvent, ServNum: 6})
+	if !PartitionSuspected() {
+		t.Error("a server we didn't lose coming back healed the partition")
+	}
+	partition.handle(MembershipEvent{Type: RefutedEvent, ServNum: 3})
+	if PartitionSuspected() {
+		t.Error("a lost server coming back didn't heal the partition")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive, 2: Alive, 3: Alive, 4: Failed})
+	run := func(servNum int) time.Time { return time.Unix(int64(servNum), 0) }
+	MemList.Merge([]MembershipId{
+		// Claims from the other side about servers we can reach
+		{TimeStamp: run(2), ServNum: 2, Incarnation: 0, State: Failed},
+		{TimeStamp: run(3), ServNum: 3, Incarnation: 0, State: Suspect},
+		// A server only the other side knows about
+		{TimeStamp: run(5), ServNum: 5, Incarnation: 0, State: Alive},
+		// A server we lost that refuted its failure over there
+		{TimeStamp: run(4), ServNum: 4, Incarnation: 1, State: Alive},
+		// A claim about us, which we refute
+		{TimeStamp: run(1), ServNum: 1, Incarnation: 0, State: Failed},
+	}, 4)
+
+	want := map[int]MemberState{1: Alive, 2: Alive, 3: Alive, 4: Alive, 5: Alive}
+	for servNum, wantState := range want {
+		if state, known := MemList.State(servNum); !known || state != wantState {
+			t.Errorf("server %d is %v (known %v), want %v", servNum, state, known, wantState)
+		}
+	}
+	if incarnation := MemList.Get(1).Id.Incarnation; incarnation != 1 {
+		t.Errorf("our incarnation is %d, want 1 after refuting", incarnation)
+	}
+}
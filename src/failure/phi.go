@@ -0,0 +1,161 @@
+package failure
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// Pings the finger table like the ping detector, but instead of waiting for an ACK timeout it
+// learns how far apart each server's ACKs usually are. Phi is how unlikely it is that we'd still
+// be waiting for the next ACK if the server were alive, as -log10 of the probability, so a
+// phi of 8 means a 1 in 10^8 chance. Servers are suspected once phi crosses PhiThreshold.
+// See "The phi accrual failure detector" by Hayashibara et al.
+type phiDetector struct {
+	baseDetector
+	// The servers we are pinging, whose ACKs we expect, and when we started pinging them
+	targets      map[int]time.Time
+	targetsMutex sync.Mutex
+}
+
+func (detector *phiDetector) Start() {
+	detector.openPorts()
+	go func() {
+		for {
+			detector.updateTargets()
+			detector.ping()
+			interval := nextPingInterval()
+			sleepStart := time.Now()
+			time.Sleep(interval)
+			checkRoundDelay(sleepStart, interval)
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(suspicionCheckInterval)
+			detector.checkPhi()
+		}
+	}()
+}
+
+// Updates the finger table, and starts the ACK history over for servers we just started pinging,
+// since the gap since we last pinged them says nothing about them
+func (detector *phiDetector) updateTargets() {
+	detector.targetsMutex.Lock()
+	defer detector.targetsMutex.Unlock()
+	targets := map[int]time.Time{}
+	for _, servNum := range fingerTargets() {
+		if started, ok := detector.targets[servNum]; ok {
+			targets[servNum] = started
+			continue
+		}
+		targets[servNum] = time.Now()
+		entry := MemList.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		entry.Mutex.Lock()
+		entry.resetACKHistory()
+		entry.Mutex.Unlock()
+	}
+	detector.targets = targets
+}
+
+func (detector *phiDetector) ping() {
+	if shared.PrintFailDetectInfo {
+		println("Mem list: " + MemList.Str(true))
+	}
+
+	detector.targetsMutex.Lock()
+	defer detector.targetsMutex.Unlock()
+	for servNum := range detector.targets {
+		changedML := broadcasts.Next(shared.Config.Failure.MaxPiggyback)
+		markPingSent(servNum)
+		sendMessage(servNum, pingPort, Message{Type: PingMsg, Sender: ownServerNum, Ids: changedML})
+	}
+}
+
+// Suspects every server we are pinging whose phi is over the threshold
+func (detector *phiDetector) checkPhi() {
+	detector.targetsMutex.Lock()
+	defer detector.targetsMutex.Unlock()
+	for servNum, started := range detector.targets {
+		entry := MemList.Get(servNum)
+		if entry == nil {
+			continue
+		}
+		entry.Mutex.Lock()
+		lastHeard := entry.LastACK
+		if lastHeard.Before(started) {
+			lastHeard = started
+		}
+		waited := time.Since(lastHeard)
+		// An unhealthy server gives the others more time, as if less time had passed
+		phi := entry.Phi(waited / time.Duration(HealthScore()+1))
+		if entry.Id.State == Alive && phi > shared.Config.Failure.PhiThreshold {
+			health.raise(fmt.Sprintf("server %d stopped ACKing", servNum))
+			entry.setState(Suspect, fmt.Sprintf("phi was %.2f after %v without an ACK", phi, waited))
+			fileLog.Printf("I suspect server %d has failed, phi is %.2f after %v without an ACK\n", servNum, phi, waited)
+		}
+		entry.Mutex.Unlock()
+	}
+}
+
+// Records an ACK that arrived at the given time.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) recordACK(at time.Time) {
+	if !mlEntry.LastACK.IsZero() {
+		mlEntry.ACKIntervals = append(mlEntry.ACKIntervals, at.Sub(mlEntry.LastACK))
+		if window := shared.Config.Failure.PhiWindow; len(mlEntry.ACKIntervals) > window {
+			mlEntry.ACKIntervals = mlEntry.ACKIntervals[len(mlEntry.ACKIntervals)-window:]
+		}
+	}
+	mlEntry.LastACK = at
+}
+
+// Forgets the ACK history, so the next ACK starts it over.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) resetACKHistory() {
+	mlEntry.ACKIntervals = nil
+	mlEntry.LastACK = time.Time{}
+}
+
+// Returns the mean and standard deviation of the gaps between ACKs.
+// Until there is any history, the gap is assumed to be the current ping interval.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) ACKStats() (mean, stdDev time.Duration) {
+	if len(mlEntry.ACKIntervals) == 0 {
+		return currentPingInterval(), shared.PhiMinStdDev
+	}
+
+	var sum float64
+	for _, interval := range mlEntry.ACKIntervals {
+		sum += float64(interval)
+	}
+	avg := sum / float64(len(mlEntry.ACKIntervals))
+
+	var squares float64
+	for _, interval := range mlEntry.ACKIntervals {
+		squares += (float64(interval) - avg) * (float64(interval) - avg)
+	}
+	mean = time.Duration(avg)
+	stdDev = time.Duration(math.Sqrt(squares / float64(len(mlEntry.ACKIntervals))))
+	// A very steady history would make the slightest delay look like a failure
+	if stdDev < shared.PhiMinStdDev {
+		stdDev = shared.PhiMinStdDev
+	}
+	return
+}
+
+// Returns phi after waiting the given time for an ACK, assuming gaps between ACKs are normally distributed.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) Phi(waited time.Duration) float64 {
+	mean, stdDev := mlEntry.ACKStats()
+
+	// Chance that the next ACK comes even later than this
+	pLater := 0.5 * math.Erfc(float64(waited-mean)/(float64(stdDev)*math.Sqrt2))
+	return -math.Log10(pLater)
+}
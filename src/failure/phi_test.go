@@ -0,0 +1,71 @@
+package failure
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"shared"
+)
+
+func TestPhi(t *testing.T) {
+	steady := &MembershipEntry{}
+	for i := 0; i < 10; i++ {
+		steady.ACKIntervals = append(steady.ACKIntervals, time.Second)
+	}
+	jittery := &MembershipEntry{ACKIntervals: []time.Duration{500 * time.Millisecond, 1500 * time.Millisecond}}
+
+	tests := []struct {
+		name   string
+		entry  *MembershipEntry
+		waited time.Duration
+		want   float64
+	}{
+		// Half of the next ACKs come later than the mean
+		{"at the mean", steady, time.Second, -math.Log10(0.5)},
+		// A steady history still gets PhiMinStdDev of spread
+		{"one min std dev late", steady, time.Second + shared.PhiMinStdDev, -math.Log10(0.5 * math.Erfc(1/math.Sqrt2))},
+		{"three min std devs late", steady, time.Second + 3*shared.PhiMinStdDev, -math.Log10(0.5 * math.Erfc(3/math.Sqrt2))},
+		{"early", steady, 0, -math.Log10(0.5 * math.Erfc(-(float64(time.Second)/float64(shared.PhiMinStdDev))/math.Sqrt2))},
+		// Mean 1s, standard deviation 500ms
+		{"jittery, one std dev late", jittery, 1500 * time.Millisecond, -math.Log10(0.5 * math.Erfc(1/math.Sqrt2))},
+	}
+	for _, test := range tests {
+		if got := test.entry.Phi(test.waited); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: Phi(%v) = %v, want %v", test.name, test.waited, got, test.want)
+		}
+	}
+
+	// Phi only goes up the longer we wait
+	last := -1.0
+	for waited := time.Duration(0); waited < 3*time.Second; waited += 50 * time.Millisecond {
+		phi := steady.Phi(waited)
+		if phi < last {
+			t.Fatalf("Phi(%v) = %v went down from %v", waited, phi, last)
+		}
+		last = phi
+	}
+	if last < shared.Config.Failure.PhiThreshold {
+		t.Errorf("Phi after 3s of steady 1s ACKs is %v, under the threshold %v", last, shared.Config.Failure.PhiThreshold)
+	}
+}
+
+func TestACKStats(t *testing.T) {
+	entry := &MembershipEntry{}
+	start := time.Now()
+	for i := 0; i <= shared.Config.Failure.PhiWindow+5; i++ {
+		entry.recordACK(start.Add(time.Duration(i) * time.Second))
+	}
+	if len(entry.ACKIntervals) != shared.Config.Failure.PhiWindow {
+		t.Errorf("kept %d ACK gaps, want PhiWindow %d", len(entry.ACKIntervals), shared.Config.Failure.PhiWindow)
+	}
+	mean, stdDev := entry.ACKStats()
+	if mean != time.Second || stdDev != shared.PhiMinStdDev {
+		t.Errorf("ACKStats() = %v, %v, want 1s, %v", mean, stdDev, shared.PhiMinStdDev)
+	}
+
+	entry.resetACKHistory()
+	if mean, stdDev := entry.ACKStats(); mean != currentPingInterval() || stdDev != shared.PhiMinStdDev {
+		t.Errorf("ACKStats() with no history = %v, %v, want the ping interval and %v", mean, stdDev, shared.PhiMinStdDev)
+	}
+}
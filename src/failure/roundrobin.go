@@ -0,0 +1,78 @@
+package failure
+
+import (
+	"math/rand"
+)
+
+// Instead of always pinging the same finger table, the ping detector can walk through a shuffled
+// list of every other alive server, a few each round, and shuffle it again once it reaches the end.
+// New servers are put somewhere in the part of the list not yet pinged in this pass. Every server
+// is pinged once per pass, so with n servers and k pings per round it is pinged at least once
+// every 2*ceil(n/k) rounds, and by every other server rather than the same few.
+// See section 4.3 of "SWIM" by Das et al.
+type roundRobin struct {
+	order []int
+	// Where in order the next round starts
+	pos int
+	// The servers in order
+	inOrder map[int]bool
+}
+
+// Returns the next count servers to ping, or every server if there are fewer.
+// Only the ping loop calls this, so it doesn't need a lock.
+func (rr *roundRobin) next(count int) (targets []int) {
+	rr.sync()
+	if count > len(rr.order) {
+		count = len(rr.order)
+	}
+
+	picked := map[int]bool{}
+	for len(targets) < count {
+		if rr.pos >= len(rr.order) {
+			rand.Shuffle(len(rr.order), func(i, j int) { rr.order[i], rr.order[j] = rr.order[j], rr.order[i] })
+			rr.pos = 0
+		}
+		servNum := rr.order[rr.pos]
+		rr.pos++
+		// After a reshuffle, a server from the end of the last pass could come up again
+		if !picked[servNum] {
+			picked[servNum] = true
+			targets = append(targets, servNum)
+		}
+	}
+	return
+}
+
+// Takes servers that are no longer alive out of the order, and puts new ones in
+func (rr *roundRobin) sync() {
+	alive := map[int]bool{}
+	for _, servNum := range MemList.AliveServers() {
+		if servNum != ownServerNum {
+			alive[servNum] = true
+		}
+	}
+
+	kept := make([]int, 0, len(rr.order))
+	for i, servNum := range rr.order {
+		if alive[servNum] {
+			kept = append(kept, servNum)
+			continue
+		}
+		delete(rr.inOrder, servNum)
+		if i < rr.pos {
+			rr.pos--
+		}
+	}
+	rr.order = kept
+
+	for servNum := range alive {
+		if rr.inOrder[servNum] {
+			continue
+		}
+		rr.inOrder[servNum] = true
+		at := rr.pos + rand.Intn(len(rr.order)-rr.pos+1)
+		rr.order = append(rr.order, 0)
+		copy(rr.order[at+1:], rr.order[at:])
+		rr.order[at] = servNum
+	}
+}
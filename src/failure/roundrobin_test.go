@@ -0,0 +1,74 @@
+package failure
+
+import (
+	"testing"
+)
+
+func TestRoundRobinBoundedProbing(t *testing.T) {
+	tests := []struct {
+		numServers, perRound int
+	}{
+		{2, 4},
+		{5, 1},
+		{6, 2},
+		{10, 4},
+	}
+	for _, test := range tests {
+		states := map[int]MemberState{}
+		for servNum := 1; servNum <= test.numServers; servNum++ {
+			states[servNum] = Alive
+		}
+		setMembers(states)
+		rr := &roundRobin{inOrder: map[int]bool{}}
+
+		others := test.numServers - 1
+		roundsPerPass := (others + test.perRound - 1) / test.perRound
+		bound := 2 * roundsPerPass
+		lastPinged := map[int]int{}
+		for round := 1; round <= 50*bound; round++ {
+			targets := rr.next(test.perRound)
+			want := test.perRound
+			if want > others {
+				want = others
+			}
+			if len(targets) != want {
+				t.Fatalf("%d servers, %d per round: round %d pinged %v, want %d servers", test.numServers, test.perRound, round, targets, want)
+			}
+			seen := map[int]bool{}
+			for _, servNum := range targets {
+				if servNum == ownServerNum || seen[servNum] {
+					t.Fatalf("%d servers, %d per round: round %d pinged %v", test.numServers, test.perRound, round, targets)
+				}
+				seen[servNum] = true
+				lastPinged[servNum] = round
+			}
+			for servNum := 2; servNum <= test.numServers; servNum++ {
+				if round-lastPinged[servNum] >= bound {
+					t.Fatalf("%d servers, %d per round: server %d not pinged for %d rounds, bound is %d",
+						test.numServers, test.perRound, servNum, round-lastPinged[servNum], bound)
+				}
+			}
+		}
+	}
+}
+
+func TestRoundRobinFollowsMembership(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive, 2: Alive, 3: Alive, 4: Alive})
+	rr := &roundRobin{inOrder: map[int]bool{}}
+	rr.next(1)
+
+	// Failed servers are taken out, and new ones get pinged within the next pass
+	setMembers(map[int]MemberState{1: Alive, 2: Alive, 3: Failed, 4: Alive, 5: Alive})
+	pinged := map[int]bool{}
+	for round := 0; round < 2*3; round++ {
+		for _, servNum := range rr.next(1) {
+			if servNum == 3 {
+				t.Fatalf("round %d pinged failed server 3", round)
+			}
+			pinged[servNum] = true
+		}
+	}
+	if !pinged[5] {
+		t.Errorf("new server 5 was never pinged, pinged %v", pinged)
+	}
+}
@@ -0,0 +1,30 @@
+package failure
+
+import (
+	"fmt"
+	"time"
+
+	"shared"
+)
+
+// Serves the membership history and view to other servers. It is registered with the default
+// RPC server, which answers on the grep port.
+type Membership struct{}
+
+// Calls the method on the server's Membership RPC, giving up after GrepTimeout
+func callMembership(server int, method string, args interface{}, reply interface{}) error {
+	node := shared.GetNode(server)
+	client, dialErr := shared.DialRPC(server, node.Endpoint(node.Ports.Grep), shared.GrepRPCTraffic)
+	if dialErr != nil {
+		return dialErr
+	}
+	defer client.Close()
+
+	call := client.Go(method, args, reply, nil)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(shared.GrepTimeout):
+		return fmt.Errorf("timed out after %v", shared.GrepTimeout)
+	}
+}
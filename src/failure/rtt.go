@@ -0,0 +1,172 @@
+package failure
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"shared"
+)
+
+// Instead of fixed timeouts, every direct ping is timed until its ACK comes back. A server's
+// ACK timeout is the mean of its last few round trips plus RTTMultiplier standard deviations,
+// so a slow link gets more slack than a fast one. Until a server has answered a ping, it gets
+// MaxACKTimeout. A ping that isn't ACKed in time is followed by an indirect probe, which gets
+// another MaxACKTimeout, so each round lasts at least the longest ACK timeout plus MaxACKTimeout,
+// and the next round can't start while a probe from the last one is still waiting. Otherwise a
+// round lasts three times the longest ACK timeout. Both are stretched by our local health score.
+
+// The ping interval picked for the current round, in nanoseconds
+var pingInterval atomic.Int64
+
+// Remembers when we pinged the server, and returns the time
+func markPingSent(servNum int) (sentAt time.Time) {
+	sentAt = time.Now()
+	entry := MemList.Get(servNum)
+	if entry == nil {
+		return
+	}
+	entry.Mutex.Lock()
+	entry.LastPingSent = sentAt
+	entry.Mutex.Unlock()
+	return
+}
+
+// Records the round trip of the ping we are waiting on, if any, with its ACK arriving at the given time,
+// and returns whether the ACK answered it in time. ACKs too late to count as an answer to the last
+// ping are ignored, since they may belong to an earlier one.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) recordRTT(at time.Time) bool {
+	if mlEntry.LastPingSent.IsZero() {
+		return false
+	}
+	rtt := at.Sub(mlEntry.LastPingSent)
+	mlEntry.LastPingSent = time.Time{}
+	if rtt < 0 || rtt > shared.Config.Failure.MaxACKTimeout.Duration {
+		return false
+	}
+
+	mlEntry.RTTs = append(mlEntry.RTTs, rtt)
+	if len(mlEntry.RTTs) > shared.RTTWindow {
+		mlEntry.RTTs = mlEntry.RTTs[len(mlEntry.RTTs)-shared.RTTWindow:]
+	}
+	return true
+}
+
+// Returns the mean and standard deviation of the recent round trips, and false if there are none.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) RTTStats() (mean, stdDev time.Duration, ok bool) {
+	if len(mlEntry.RTTs) == 0 {
+		return 0, 0, false
+	}
+
+	var sum float64
+	for _, rtt := range mlEntry.RTTs {
+		sum += float64(rtt)
+	}
+	avg := sum / float64(len(mlEntry.RTTs))
+
+	var squares float64
+	for _, rtt := range mlEntry.RTTs {
+		squares += (float64(rtt) - avg) * (float64(rtt) - avg)
+	}
+	return time.Duration(avg), time.Duration(math.Sqrt(squares / float64(len(mlEntry.RTTs)))), true
+}
+
+// Returns how long to wait for the server's ACK.
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) ackTimeout() time.Duration {
+	mean, stdDev, ok := mlEntry.RTTStats()
+	if !ok {
+		return shared.Config.Failure.MaxACKTimeout.Duration
+	}
+	if stdDev < shared.MinRTTStdDev {
+		stdDev = shared.MinRTTStdDev
+	}
+	timeout := mean + time.Duration(shared.Config.Failure.RTTMultiplier*float64(stdDev))
+	return clampDuration(timeout, shared.Config.Failure.MinACKTimeout.Duration, shared.Config.Failure.MaxACKTimeout.Duration)
+}
+
+// Returns how long to wait for the server's ACK
+func ackTimeout(servNum int) time.Duration {
+	entry := MemList.Get(servNum)
+	if entry == nil {
+		return shared.Config.Failure.MaxACKTimeout.Duration
+	}
+	entry.Mutex.Lock()
+	defer entry.Mutex.Unlock()
+	return entry.ackTimeout()
+}
+
+// Works out how long to wait before the next round of pings from the ACK timeouts of the alive servers.
+// SetConfig makes sure MaxPingInterval leaves room for a whole probe of a server that hasn't been timed.
+func nextPingInterval() time.Duration {
+	longest := shared.Config.Failure.MinACKTimeout.Duration
+	for _, servNum := range MemList.AliveServers() {
+		entry := MemList.Get(servNum)
+		if entry == nil || servNum == ownServerNum {
+			continue
+		}
+		entry.Mutex.Lock()
+		if timeout := entry.ackTimeout(); timeout > longest {
+			longest = timeout
+		}
+		entry.Mutex.Unlock()
+	}
+
+	interval := 3 * longest
+	if probe := longest + shared.Config.Failure.MaxACKTimeout.Duration; probe > interval {
+		interval = probe
+	}
+	interval = clampDuration(interval, shared.Config.Failure.MinPingInterval.Duration, shared.Config.Failure.MaxPingInterval.Duration)
+	interval = stretch(interval)
+	pingInterval.Store(int64(interval))
+	return interval
+}
+
+// Returns the ping interval picked for the current round
+func currentPingInterval() time.Duration {
+	if interval := pingInterval.Load(); interval > 0 {
+		return time.Duration(interval)
+	}
+	return shared.Config.Failure.MaxPingInterval.Duration
+}
+
+func clampDuration(value, min, max time.Duration) time.Duration {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// Returns the round trip stats for the entry, like "0.41ms ± 0.08ms over 20 pings, ACK timeout 200ms".
+// This function assumes you already have the lock to the entry.
+func (mlEntry *MembershipEntry) rttStr() string {
+	mean, stdDev, ok := mlEntry.RTTStats()
+	if !ok {
+		return "not measured"
+	}
+	return fmt.Sprintf("%v ± %v over %d pings, ACK timeout %v", mean.Round(time.Microsecond), stdDev.Round(time.Microsecond),
+		len(mlEntry.RTTs), mlEntry.ackTimeout().Round(time.Millisecond))
+}
+
+// Returns the round trip stats of every server we have timed, one per line
+func (ml *MembershipList) RTTStr() (ret string) {
+	for _, servNum := range ml.ServerNumbers() {
+		entry := ml.Get(servNum)
+		if entry == nil || servNum == ownServerNum {
+			continue
+		}
+		entry.Mutex.Lock()
+		if len(entry.RTTs) > 0 {
+			ret += fmt.Sprintf("Server %d: %s\n", servNum, entry.rttStr())
+		}
+		entry.Mutex.Unlock()
+	}
+	ret += fmt.Sprintf("Ping interval: %v\n", currentPingInterval().Round(time.Millisecond))
+	return
+}
@@ -0,0 +1,121 @@
+package failure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"shared"
+)
+
+// Every SnapshotInterval the membership list is saved to membershipN.json in our log folder.
+// When we restart, servers that were alive are asked to let us back in before the seeds, so we
+// can rejoin even if the seeds are down, and servers that had failed or left go straight into
+// the graveyard, so old news about them can't bring them back. Our own entry isn't restored,
+// since a restart is a new run with a new timestamp. Whatever the server that lets us in sends
+// back overrides the snapshot.
+
+// How many of the servers from the snapshot to ask to join before trying the seeds
+const maxKnownPeersToAsk = 3
+
+type membershipSnapshot struct {
+	SavedAt    time.Time
+	Members    []MembershipId
+	Tombstones []MembershipId
+}
+
+// Servers that were alive when the snapshot we started from was saved
+var knownPeers []int
+
+// The last snapshot written, so an unchanged list isn't written again
+var lastSnapshot []byte
+
+// Held while saving, since the ticker and Leave both save, and share lastSnapshot and the tmp file
+var snapshotMutex sync.Mutex
+
+func snapshotPath() string {
+	return shared.LogPath(fmt.Sprintf("membership%d.json", ownServerNum))
+}
+
+// Every SnapshotInterval, saves the membership list if it changed
+func saveSnapshots() {
+	for {
+		time.Sleep(shared.Config.Failure.SnapshotInterval.Duration)
+		if saveErr := saveSnapshot(); saveErr != nil {
+			fileLog.Printf("Couldn't save the membership snapshot: %v\n", saveErr)
+		}
+	}
+}
+
+// Writes the membership list to the snapshot file, replacing the old one all at once
+func saveSnapshot() error {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	var members []MembershipId
+	for _, id := range Detector.Members() {
+		// Heartbeats change every round and mean nothing to a new run
+		id.Heartbeat = 0
+		members = append(members, id)
+	}
+
+	// Compared without the time, so it only changes when the list does
+	data, encodeErr := json.Marshal(membershipSnapshot{Members: members, Tombstones: MemList.Tombstones()})
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if bytes.Equal(data, lastSnapshot) {
+		return nil
+	}
+	lastSnapshot = data
+
+	data, _ = json.MarshalIndent(membershipSnapshot{SavedAt: time.Now(), Members: members, Tombstones: MemList.Tombstones()}, "", "\t")
+	tmpPath := snapshotPath() + ".tmp"
+	if writeErr := ioutil.WriteFile(tmpPath, data, 0666); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tmpPath, snapshotPath())
+}
+
+// Loads the snapshot left by our last run, if any, burying the servers that had failed or left,
+// and remembering a few of the ones that were alive to ask to join first
+func loadSnapshot() {
+	data, readErr := ioutil.ReadFile(snapshotPath())
+	if os.IsNotExist(readErr) {
+		return
+	}
+	var snapshot membershipSnapshot
+	if readErr == nil {
+		readErr = json.Unmarshal(data, &snapshot)
+	}
+	if readErr != nil {
+		fileLog.Printf("Ignoring the membership snapshot: %v\n", readErr)
+		return
+	}
+
+	MemList.ServersMutex.Lock()
+	for _, id := range append(snapshot.Tombstones, snapshot.Members...) {
+		if id.ServNum == ownServerNum || shared.GetNode(id.ServNum) == nil {
+			continue
+		}
+		if id.State == Failed || id.State == Left {
+			MemList.Graveyard[id.ServNum] = id
+		} else {
+			knownPeers = append(knownPeers, id.ServNum)
+		}
+	}
+	buried := len(MemList.Graveyard)
+	MemList.ServersMutex.Unlock()
+
+	rand.Shuffle(len(knownPeers), func(i, j int) { knownPeers[i], knownPeers[j] = knownPeers[j], knownPeers[i] })
+	if len(knownPeers) > maxKnownPeersToAsk {
+		knownPeers = knownPeers[:maxKnownPeersToAsk]
+	}
+	fileLog.Printf("Loaded the membership snapshot from %v ago, will ask servers %v to join first, and buried %d servers\n",
+		time.Since(snapshot.SavedAt).Round(time.Second), knownPeers, buried)
+}
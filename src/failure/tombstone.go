@@ -0,0 +1,83 @@
+package failure
+
+import (
+	"sort"
+	"time"
+
+	"shared"
+)
+
+// Failed and left servers stay in the membership list as tombstones for TombstoneExpiry, so
+// the news has time to reach everyone, and are then dropped. Their last id goes into the
+// graveyard, where it is kept for as long as we run. Anything we hear about the same run of
+// a buried server is ignored, unless it has a higher incarnation because the server refuted
+// its failure. A new run of the server joins like any other.
+
+// How often to look for tombstones that have expired
+const tombstoneCheckInterval = time.Second
+
+func collectTombstones() {
+	for {
+		time.Sleep(tombstoneCheckInterval)
+		MemList.dropExpired()
+	}
+}
+
+// Moves every server that has been failed or left for longer than TombstoneExpiry to the graveyard
+func (ml *MembershipList) dropExpired() {
+	var dropped []MembershipId
+
+	// Always take the list lock before an entry's lock
+	ml.ServersMutex.Lock()
+	for servNum, entry := range ml.Servers {
+		if servNum == ownServerNum {
+			continue
+		}
+		entry.Mutex.Lock()
+		if (entry.Id.State == Failed || entry.Id.State == Left) && time.Since(entry.StateChanged) > shared.Config.Failure.TombstoneExpiry.Duration {
+			ml.Graveyard[servNum] = entry.Id
+			delete(ml.Servers, servNum)
+			dropped = append(dropped, entry.Id)
+		}
+		entry.Mutex.Unlock()
+	}
+	ml.ServersMutex.Unlock()
+
+	for _, id := range dropped {
+		fileLog.Printf("Forgetting server %d, which has been %v for over %v\n", id.ServNum, id.State, shared.Config.Failure.TombstoneExpiry.Duration)
+	}
+	if len(dropped) > 0 {
+		ml.markChanged()
+	}
+}
+
+// Returns whether the id is about a buried server, and no newer than what we buried
+func (ml *MembershipList) isStale(id MembershipId) bool {
+	buried, ok := ml.Buried(id.ServNum)
+	if !ok {
+		return false
+	}
+	if id.TimeStamp.After(buried.TimeStamp) {
+		return false
+	}
+	return id.TimeStamp.Before(buried.TimeStamp) || id.Incarnation <= buried.Incarnation
+}
+
+// Returns the last id of the server, if it has been buried
+func (ml *MembershipList) Buried(servNum int) (id MembershipId, ok bool) {
+	ml.ServersMutex.RLock()
+	defer ml.ServersMutex.RUnlock()
+	id, ok = ml.Graveyard[servNum]
+	return
+}
+
+// Returns the last id of every buried server, in order of server number
+func (ml *MembershipList) Tombstones() (ids []MembershipId) {
+	ml.ServersMutex.RLock()
+	for _, id := range ml.Graveyard {
+		ids = append(ids, id)
+	}
+	ml.ServersMutex.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i].ServNum < ids[j].ServNum })
+	return
+}
@@ -0,0 +1,79 @@
+package failure
+
+import (
+	"testing"
+	"time"
+
+	"shared"
+)
+
+func TestIsStale(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive})
+	buried := MembershipId{TimeStamp: time.Unix(2, 0), ServNum: 2, Incarnation: 1, State: Failed}
+	MemList.Graveyard[2] = buried
+
+	tests := []struct {
+		name string
+		id   MembershipId
+		want bool
+	}{
+		{"same run and incarnation", MembershipId{TimeStamp: time.Unix(2, 0), ServNum: 2, Incarnation: 1, State: Alive}, true},
+		{"older incarnation", MembershipId{TimeStamp: time.Unix(2, 0), ServNum: 2, Incarnation: 0, State: Suspect}, true},
+		{"older run", MembershipId{TimeStamp: time.Unix(1, 0), ServNum: 2, Incarnation: 5, State: Alive}, true},
+		{"refuted failure", MembershipId{TimeStamp: time.Unix(2, 0), ServNum: 2, Incarnation: 2, State: Alive}, false},
+		{"new run", MembershipId{TimeStamp: time.Unix(3, 0), ServNum: 2, Incarnation: 0, State: Alive}, false},
+		{"server never buried", MembershipId{TimeStamp: time.Unix(3, 0), ServNum: 3, Incarnation: 0, State: Alive}, false},
+	}
+	for _, test := range tests {
+		if got := MemList.isStale(test.id); got != test.want {
+			t.Errorf("%s: stale %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDropExpired(t *testing.T) {
+	setMembers(map[int]MemberState{1: Failed, 2: Failed, 3: Left, 4: Failed, 5: Alive})
+	longAgo := time.Now().Add(-2 * shared.Config.Failure.TombstoneExpiry.Duration)
+	for _, servNum := range []int{1, 2, 3, 5} {
+		MemList.Get(servNum).StateChanged = longAgo
+	}
+	MemList.Get(4).StateChanged = time.Now()
+
+	MemList.dropExpired()
+
+	// We never bury ourselves, and alive or recently failed servers stay
+	for _, servNum := range []int{1, 4, 5} {
+		if MemList.Get(servNum) == nil {
+			t.Errorf("server %d was dropped from the list", servNum)
+		}
+	}
+	for _, servNum := range []int{2, 3} {
+		if MemList.Get(servNum) != nil {
+			t.Errorf("server %d is still in the list after its tombstone expired", servNum)
+		}
+		if _, ok := MemList.Buried(servNum); !ok {
+			t.Errorf("server %d wasn't buried", servNum)
+		}
+	}
+	if tombstones := MemList.Tombstones(); len(tombstones) != 2 || tombstones[0].ServNum != 2 || tombstones[1].ServNum != 3 {
+		t.Errorf("tombstones are %v, want servers 2 and 3", tombstones)
+	}
+}
+
+func TestBuriedServersStayBuried(t *testing.T) {
+	setMembers(map[int]MemberState{1: Alive})
+	buried := MembershipId{TimeStamp: time.Unix(2, 0), ServNum: 2, Incarnation: 0, State: Failed}
+	MemList.Graveyard[2] = buried
+
+	// Old news from a server that hasn't heard of the failure yet
+	MemList.Update([]MembershipId{{TimeStamp: time.Unix(2, 0), ServNum: 2, Incarnation: 0, State: Alive}}, 3)
+	if MemList.Get(2) != nil {
+		t.Fatal("stale news brought a buried server back into the list")
+	}
+
+	// The server refuting its failure lets it back in
+	MemList.Update([]MembershipId{{TimeStamp: time.Unix(2, 0), ServNum: 2, Incarnation: 1, State: Alive}}, 2)
+	if state, known := MemList.State(2); !known || state != Alive {
+		t.Errorf("server 2 is %v (known %v) after refuting its failure, want %v", state, known, Alive)
+	}
+}
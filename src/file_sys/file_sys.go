@@ -1,15 +1,19 @@
 package file_sys
 
 import (
+  "bytes"
   "fmt"
   "io"
   "io/ioutil"
-  // "log"
+  "log"
   "os"
   "path/filepath"
+  "sort"
   "strings"
   "strconv"
+  "time"
 
+	"failure"
 	"shared"
 )
 
@@ -17,12 +21,14 @@ import (
 // According to stack overflow, we can map '/' to the unicode division '/'
 // https://github.com/ncw/rclone/issues/62
 
-const SDFS_Folder = "sdfs_files/"
+var SDFS_Folder = shared.DefaultDataDir
 const versionDelimeter = "~"
 const maxNumVersions = 4
-var fileSysLog = shared.OpenLogFile(fmt.Sprintf("fileSys%d.log", shared.GetOwnServerNumber()))
+const partitionCheckInterval = 1 * time.Second
+var fileSysLog *log.Logger
 
-func PutFile(localFname, sdfsFname string, localFile []byte) error {
+// Every replica stamps the new version with putTime, so they all agree on which version is which
+func PutFile(localFname, sdfsFname string, localFile []byte, putTime time.Time) error {
   curVersions, globErr := filepath.Glob(sdfsFname + versionDelimeter + "*")
 	if globErr != nil {
 		return fmt.Errorf("there is an error: %s: %v\n", globErr.Error(), sdfsFname)
@@ -46,9 +52,13 @@ func PutFile(localFname, sdfsFname string, localFile []byte) error {
     return fmt.Errorf("File error on sdfs file: %s\n", sdfsErr)
   }
   _, writeErr := sdfsF.Write(localFile)
+  sdfsF.Close()
   if writeErr != nil {
     return writeErr
   }
+  if !putTime.IsZero() {
+    os.Chtimes(sdfsFname, putTime, putTime)
+  }
   fileSysLog.Printf("Wrote contents of %s to %s", localFname, sdfsFname)
   return nil
 }
@@ -142,23 +152,83 @@ func GetVersions(sdfsFname string, numVersions int, localFname string) (s []byte
   return
 }
 
-func ReceiveFile(baseFname string, contents []byte) error {
-  sdfsFname := baseFname
-  os.Remove(sdfsFname)
+type fileVersion struct {
+  contents []byte
+  modTime time.Time
+}
 
-  // Possible race conditions but I think it doesn't matter because each one does the same thing
-  sdfsF, sdfsErr := os.OpenFile(sdfsFname, os.O_RDWR|os.O_CREATE, 0600)
-  if sdfsErr != nil {
-    return fmt.Errorf("File error with replication of: %s\n", sdfsErr)
+// Adds a replica sent by another server to the file's versions. Both sides of a partition
+// may have written the file, so the versions are merged by mod time instead of by name.
+func ReceiveFile(fname string, contents []byte, modTime time.Time) error {
+  if modTime.IsZero() {
+    modTime = time.Now()
   }
-  _, writeErr := sdfsF.Write(contents)
-  if writeErr != nil {
-    return writeErr
+  sdfsFname := strings.Split(fname, versionDelimeter)[0]
+  oldNames, globErr := filepath.Glob(sdfsFname + versionDelimeter + "*")
+  if globErr != nil {
+    return fmt.Errorf("%s: %v\n", globErr.Error(), sdfsFname)
+  }
+  if _, statErr := os.Stat(sdfsFname); statErr == nil {
+    oldNames = append([]string{sdfsFname}, oldNames...)
   }
-  fileSysLog.Printf("Updated contents of %s", sdfsFname)
+
+  var versions []fileVersion
+  for _, name := range oldNames {
+    info, statErr := os.Stat(name)
+    if statErr != nil {
+      continue
+    }
+    old, readErr := ioutil.ReadFile(name)
+    if readErr != nil {
+      return readErr
+    }
+    // Every replica of a put has the put's time, so a copy of a version we hold matches it
+    if info.ModTime().Equal(modTime) && bytes.Equal(old, contents) {
+      fileSysLog.Printf("Already had this version of %s", sdfsFname)
+      return nil
+    }
+    versions = append(versions, fileVersion{contents: old, modTime: info.ModTime()})
+  }
+  versions = append(versions, fileVersion{contents: contents, modTime: modTime})
+  sort.SliceStable(versions, func(i, j int) bool {
+    return versions[i].modTime.After(versions[j].modTime)
+  })
+  if len(versions) > maxNumVersions+1 {
+    versions = versions[:maxNumVersions+1]
+  }
+
+  // Renumber the merged versions, newest first
+  for _, name := range oldNames {
+    os.Remove(name)
+  }
+  for i, version := range versions {
+    name := sdfsFname
+    if i > 0 {
+      name = fmt.Sprintf("%s%s%d", sdfsFname, versionDelimeter, i)
+    }
+    if writeErr := ioutil.WriteFile(name, version.contents, 0600); writeErr != nil {
+      return fmt.Errorf("File error with replication of: %s\n", writeErr)
+    }
+    // Keep the put's mod time, so every replica agrees on the order of the versions
+    os.Chtimes(name, version.modTime, version.modTime)
+  }
+  fileSysLog.Printf("Merged a version of %s, it has %d versions now", sdfsFname, len(versions))
   return nil
 }
 
+// Sends the local copy of a file in the SDFS folder to the server
+func sendReplica(name string, server int) error {
+  info, statErr := os.Stat(SDFS_Folder + name)
+  if statErr != nil {
+    return statErr
+  }
+  contents, readErr := ioutil.ReadFile(SDFS_Folder + name)
+  if readErr != nil {
+    return readErr
+  }
+  return RemoteSendFile(name, contents, info.ModTime(), server)
+}
+
 func copyFile(src string, destF *os.File) error {
   srcF, srcErr := os.Open(src)
   if srcErr != nil {
@@ -183,15 +253,62 @@ func copyFile(src string, destF *os.File) error {
 }
 
 func Initialize() {
+  SDFS_Folder = shared.OwnNode().DataDir
+  fileSysLog = shared.OpenLogFile(fmt.Sprintf("fileSys%d.log", shared.GetOwnServerNumber()))
+
   // TODO: Uncomment when not testing stuff
   os.RemoveAll(SDFS_Folder)
-  os.Mkdir(SDFS_Folder, os.ModePerm)
-  go ListenForMembershipListChanges()
+  os.MkdirAll(SDFS_Folder, os.ModePerm)
+  go ListenForMembershipListChanges(failure.Detector.Subscribe())
   go openFilePortForRPCInGoRoutine()
 }
 
-func Leave() {
+// Hands every local file and version off to the server taking over our replica slot,
+// and waits for each one to confirm it has the file, so leaving doesn't cost a replica
+func Leave() error {
+  ownServerNum := shared.GetOwnServerNumber()
+  aliveServers := failure.MemList.AliveServers()
+  var remainingServers []int
+  for _, server := range aliveServers {
+    if server != ownServerNum {
+      remainingServers = append(remainingServers, server)
+    }
+  }
+
+  files, fileErr := ioutil.ReadDir(SDFS_Folder)
+  if fileErr != nil {
+    return fileErr
+  }
 
+  failed := 0
+  for _, f := range files {
+    // Ignore the version when hashing the file
+    splitName := strings.Split(f.Name(), versionDelimeter)
+    oldServers := GetMachinesHoldingFileFromMemList(splitName[0], aliveServers)
+    newServers := GetMachinesHoldingFileFromMemList(splitName[0], remainingServers)
+
+    for _, server := range newServers {
+      if containsServer(oldServers, server) {
+        continue
+      }
+      if sendErr := sendReplica(f.Name(), server); sendErr != nil {
+        fileSysLog.Printf("Couldn't hand %s off to server %d: %v\n", f.Name(), server, sendErr)
+        failed++
+        continue
+      }
+      fileSysLog.Printf("Handed %s off to server %d\n", f.Name(), server)
+    }
+  }
+
+  if failed > 0 {
+    return fmt.Errorf("%d files couldn't be handed off, see the file system log", failed)
+  }
+  return nil
+}
+
+// SDFS names are sent between servers without a folder, each server keeps them in its own data folder
+func sdfsPath(sdfsFname string) string {
+  return SDFS_Folder + sdfsFname
 }
 
 func replaceSlashWithDivision(filename string) (string) {
@@ -214,7 +331,7 @@ func HandleFileCmd(cmd string, args []string) error {
         return err
       }
 
-      putArgs := shared.FileArgs{args[0], SDFS_Folder+replaceSlashWithDivision(args[1]), content, 0}
+      putArgs := shared.FileArgs{LocalFname: args[0], SdfsFname: replaceSlashWithDivision(args[1]), FileContents: content}
       putErr := MakeRemoteCall("Put", putArgs)
       return putErr
     }
@@ -225,16 +342,14 @@ func HandleFileCmd(cmd string, args []string) error {
       if strings.Contains(args[1], "~") {
         return fmt.Errorf("Local filename cannot contain %s character\n", versionDelimeter)
       }
-      var emptyByteArray []byte
-      getArgs := shared.FileArgs{args[1], SDFS_Folder+replaceSlashWithDivision(args[0]), emptyByteArray, 0}
+      getArgs := shared.FileArgs{LocalFname: args[1], SdfsFname: replaceSlashWithDivision(args[0])}
       return MakeRemoteCall("Get", getArgs)
     }
     case "delete": {
       if len(args) != 1 {
         return fmt.Errorf("usage: %s sdfs_filename", cmd)
       }
-      var emptyByteArray []byte
-      deleteArgs := shared.FileArgs{"", SDFS_Folder+replaceSlashWithDivision(args[0]), emptyByteArray, 0}
+      deleteArgs := shared.FileArgs{SdfsFname: replaceSlashWithDivision(args[0])}
       deleteErr := MakeRemoteCall("Delete", deleteArgs)
       return deleteErr
     }
@@ -242,8 +357,7 @@ func HandleFileCmd(cmd string, args []string) error {
       if len(args) != 1 {
         return fmt.Errorf("usage: %s sdfs_filename", cmd)
       }
-      var emptyByteArray []byte
-      lsArgs := shared.FileArgs{"", SDFS_Folder+replaceSlashWithDivision(args[0]), emptyByteArray, 0}
+      lsArgs := shared.FileArgs{SdfsFname: replaceSlashWithDivision(args[0])}
       lsErr := MakeRemoteCall("LS", lsArgs)
       return lsErr
     }
@@ -261,18 +375,17 @@ func HandleFileCmd(cmd string, args []string) error {
         return fmt.Errorf("Local filename cannot contain %s character\n", versionDelimeter)
       }
       numVersions, _ := strconv.Atoi(args[1])
-      var emptyByteArray []byte
-      getVerArgs := shared.FileArgs{args[2], SDFS_Folder+replaceSlashWithDivision(args[0]), emptyByteArray, numVersions}
+      getVerArgs := shared.FileArgs{LocalFname: args[2], SdfsFname: replaceSlashWithDivision(args[0]), NumVersions: numVersions}
       return MakeRemoteCall("GetVersions", getVerArgs)
     }
     case "test": {
       if len(args) != 1 {
         return fmt.Errorf("usage: %s sdfs_filename", cmd)
       }
-      old := []bool{false, true, false, true, true, true, true, true, true, true, true}
-      new := []bool{false, true, true, true, true, true, true, true, true, true, true}
+      old := []int{1, 3, 4, 5, 6, 7, 8, 9, 10}
+      new := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
 
-      //replicas := GetMachinesHoldingFileFromMemList(SDFS_Folder+replaceSlashWithDivision(args[0]), old)
+      //replicas := GetMachinesHoldingFileFromMemList(replaceSlashWithDivision(args[0]), old)
       //fmt.Printf("replicas: %v\n", replicas)
 
       return SendReplicas(old, new)
@@ -289,17 +402,44 @@ func HandleFileCmd(cmd string, args []string) error {
   return nil
 }
 
-func ListenForMembershipListChanges() error {
+// Moves replicas around whenever the alive servers change, and reconciles them after a partition
+func ListenForMembershipListChanges(events <-chan failure.MembershipEvent) error {
+  aliveServers := failure.MemList.AliveServers()
+  partitioned := false
   for {
-    memListStruct := <- shared.GlobalMembershipChannel
+    // Partitions are detected on their own goroutine, so check on them every so often too
+    select {
+    case event := <- events:
+      fileSysLog.Printf("Membership event: %v\n", event)
+    case <- time.After(partitionCheckInterval):
+    }
 
-    SendReplicas(memListStruct.OldList, memListStruct.NewList)
-  }
+    if failure.PartitionSuspected() {
+      partitioned = true
+    } else if partitioned {
+      partitioned = false
+      fileSysLog.Printf("The partition has healed, reconciling replicas\n")
+      ReconcileReplicas()
+    }
 
-  return nil
+    // While in the minority, the servers we lost probably still have their replicas
+    if shared.Config.Failure.SuspendReplicationInMinority && failure.InMinority() {
+      fileSysLog.Printf("In the minority side of a partition, not moving replicas\n")
+      continue
+    }
+
+    // Events can be coalesced, so go by the membership list instead of the event itself
+    newAliveServers := failure.MemList.AliveServers()
+    if fmt.Sprint(aliveServers) == fmt.Sprint(newAliveServers) {
+      continue
+    }
+    SendReplicas(aliveServers, newAliveServers)
+    aliveServers = newAliveServers
+  }
 }
 
-func SendReplicas(oldMemList, newMemList []bool) error {
+// Both lists hold the numbers of the servers that are alive
+func SendReplicas(oldMemList, newMemList []int) error {
   // Get a list of files
 	files, fileErr := ioutil.ReadDir(SDFS_Folder)
   if fileErr != nil {
@@ -311,27 +451,57 @@ func SendReplicas(oldMemList, newMemList []bool) error {
     fmt.Printf("Checking if %s needs to be sent\n", f.Name())
     // Ignore the version when hashing the file
     splitName := strings.Split(f.Name(), versionDelimeter)
-    oldServers := GetMachinesHoldingFileFromMemList(SDFS_Folder + splitName[0], oldMemList)
-    newServers := GetMachinesHoldingFileFromMemList(SDFS_Folder + splitName[0], newMemList)
+    oldServers := GetMachinesHoldingFileFromMemList(splitName[0], oldMemList)
+    newServers := GetMachinesHoldingFileFromMemList(splitName[0], newMemList)
 
-    for i:=1; i<=10; i++ {
+    for _, server := range newServers {
       // Send file if new server should now have it
-      if oldServers[i] == false && newServers[i] == true {
-        contents, err := ioutil.ReadFile(SDFS_Folder + f.Name())
-        if err != nil {
-          return err
+      if !containsServer(oldServers, server) {
+        if err := sendReplica(f.Name(), server); err != nil {
+          fileSysLog.Printf("Couldn't send %s to server %d: %v\n", f.Name(), server, err)
         }
-
-        RemoteSendFile(SDFS_Folder + f.Name(), contents, i)
       }
     }
 
     // Delete file from local sdfs if the server should no longer have it
     ownServerNum := shared.GetOwnServerNumber()
-    if oldServers[ownServerNum] == true && newServers[ownServerNum] == false {
+    if containsServer(oldServers, ownServerNum) && !containsServer(newServers, ownServerNum) {
       os.Remove(SDFS_Folder + f.Name())
     }
   }
 
 	return nil
 }
+
+// Sends every local file and version to the other servers that should hold it.
+// Both sides of a partition may have written the same file, so the receivers merge the versions.
+func ReconcileReplicas() error {
+  files, fileErr := ioutil.ReadDir(SDFS_Folder)
+  if fileErr != nil {
+    return fileErr
+  }
+
+  ownServerNum := shared.GetOwnServerNumber()
+  for _, f := range files {
+    // Ignore the version when hashing the file
+    splitName := strings.Split(f.Name(), versionDelimeter)
+    for _, server := range GetMachinesHoldingFile(splitName[0]) {
+      if server == ownServerNum {
+        continue
+      }
+      if err := sendReplica(f.Name(), server); err != nil {
+        fileSysLog.Printf("Couldn't reconcile %s with server %d: %v\n", f.Name(), server, err)
+      }
+    }
+  }
+  return nil
+}
+
+func containsServer(servers []int, server int) bool {
+  for _, s := range servers {
+    if s == server {
+      return true
+    }
+  }
+  return false
+}
@@ -10,92 +10,74 @@ import (
 	"net/rpc"
 	"os"
 	"shared"
+	"sort"
 	"time"
 )
 
 type RemoteFile int
 
-var memList = failure.MemList
-
 func (t *RemoteFile) Put(args *shared.FileArgs, reply *shared.FileReply) error {
-	return PutFile(args.LocalFname, args.SdfsFname, args.FileContents)
+	return PutFile(args.LocalFname, sdfsPath(args.SdfsFname), args.FileContents, args.PutTime)
 }
 
 func (t *RemoteFile) Get(args *shared.FileArgs, reply *shared.FileReply) error {
-	data, e := GetFile(args.SdfsFname, args.LocalFname)
+	data, e := GetFile(sdfsPath(args.SdfsFname), args.LocalFname)
 	reply.FileContents = data
 	return e
 }
 
 func (t *RemoteFile) Delete(args *shared.FileArgs, reply *shared.FileReply) error {
-	onMachine, err := DeleteFile(args.SdfsFname)
+	onMachine, err := DeleteFile(sdfsPath(args.SdfsFname))
 	reply.OnMachine = onMachine
 	return err
 }
 
 func (t *RemoteFile) LS(args *shared.FileArgs, reply *shared.FileReply) error {
-	onMachine, err := LSFile(args.SdfsFname)
+	onMachine, err := LSFile(sdfsPath(args.SdfsFname))
 	reply.OnMachine = onMachine
 	return err
 }
 
 func (t *RemoteFile) GetVersions(args *shared.FileArgs, reply *shared.FileReply) error {
-	data, e := GetVersions(args.SdfsFname, args.NumVersions, args.LocalFname)
+	data, e := GetVersions(sdfsPath(args.SdfsFname), args.NumVersions, args.LocalFname)
 	reply.FileContents = data
 	return e
 }
 
-func (t *RemoteFile) SendFile(args *shared.FileArgs, reply *shared.FileReply) error {
-	return ReceiveFile(args.SdfsFname, args.FileContents)
+func (t *RemoteFile) SendFile(args *shared.ReplicaArgs, reply *shared.FileReply) error {
+	return ReceiveFile(sdfsPath(args.SdfsFname), args.FileContents, args.ModTime)
 }
 
-func GetMachinesHoldingFileFromMemList(sdfsFname string, memlist []bool) (replicas []bool) {
-	replicas = make([]bool, shared.NumServers+1)
+// A file's first replica is the server its hash picks out of every server in the config, in
+// order of id. It and the next NumFileReplicas-1 alive servers after it hold the file.
+// Returns the servers out of memlist (the alive servers) that should hold the file
+func GetMachinesHoldingFileFromMemList(sdfsFname string, memlist []int) (replicas []int) {
+	servers := shared.GetServerNumbers()
+	sort.Ints(servers)
 	hash := sha256.Sum256([]byte(sdfsFname))
-	hashint := binary.BigEndian.Uint64(hash[:])
-
-	startingMachine := (hashint % shared.NumServers) + 1
-	// fmt.Printf("First machine for %s is: %v\n", sdfsFname, startingMachine)
+	start := int(binary.BigEndian.Uint64(hash[:]) % uint64(len(servers)))
 
-	curMachine := int(startingMachine)
-	curNumReplicas := 0
-	for {
-		if curMachine < len(memlist) && memlist[curMachine] {
-			replicas[curMachine] = true
-			curNumReplicas += 1
-			// fmt.Printf("Machine %v holding %v\n", curMachine, sdfsFname)
+	for i := 0; i < len(servers) && len(replicas) < shared.NumFileReplicas; i++ {
+		server := servers[(start+i)%len(servers)]
+		if containsServer(memlist, server) {
+			replicas = append(replicas, server)
 		}
-
-		curMachine = (curMachine % shared.NumServers) + 1
-		if curMachine == int(startingMachine) || curNumReplicas == shared.NumFileReplicas { break }
 	}
 	return
 }
 
-func GetMachinesHoldingFile(sdfsFname string) (replicas []string) {
-	hash := sha256.Sum256([]byte(sdfsFname))
-	hashint := binary.BigEndian.Uint64(hash[:])
-
-	startingMachine := (hashint % shared.NumServers) + 1
-	fmt.Printf("First machine for %s is: %v\n", sdfsFname, startingMachine)
-
-	curMachine := int(startingMachine)
-	curNumReplicas := 0
-	for {
-		failure.MemList.Servers[curMachine].Mutex.Lock()
-		if failure.MemList.Servers[curMachine].Id.Failed == false {
-			replicas = append(replicas, shared.GetServerAddressFromNumber(curMachine))
-			curNumReplicas += 1
-			fmt.Printf("Machine %v holding %v\n", curMachine, sdfsFname)
-		}
-		failure.MemList.Servers[curMachine].Mutex.Unlock()
-
-		curMachine = (curMachine % shared.NumServers) + 1
-		if curMachine == int(startingMachine) || curNumReplicas == shared.NumFileReplicas { break }
-	}
+func GetMachinesHoldingFile(sdfsFname string) (replicas []int) {
+	replicas = GetMachinesHoldingFileFromMemList(sdfsFname, failure.MemList.AliveServers())
+	fmt.Printf("Machines holding %s: %v\n", sdfsFname, replicas)
 	return
 }
 
+// Returns the address of the file RPC server on the given server
+func fileEndpoint(server int) string {
+	node := shared.GetNode(server)
+	return node.Endpoint(node.Ports.File)
+}
+
 // remoteFunction needs to be the name of one of the functions above
 func MakeRemoteCall(remoteFunction string, remoteArgs shared.FileArgs) (err error) {
 	start := time.Now()
@@ -122,12 +104,13 @@ func MakeRemoteCall(remoteFunction string, remoteArgs shared.FileArgs) (err erro
 
 func RemotePut(remoteFunction string, remoteArgs shared.FileArgs) (error) {
 	replicas := GetMachinesHoldingFile(remoteArgs.SdfsFname)
+	remoteArgs.PutTime = time.Now()
 	var calls = make([]*rpc.Call, len(replicas))
 	var replies = make([]*rpc.Call, len(replicas))
 
 	// Call the remote servers
-	for index, address := range replicas {
-		conn, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", address, shared.FilePort))
+	for index, server := range replicas {
+		conn, err := shared.DialRPC(server, fileEndpoint(server), shared.FileRPCTraffic)
 
 		// The server is unable to be reached
 		if err != nil {
@@ -149,13 +132,13 @@ func RemotePut(remoteFunction string, remoteArgs shared.FileArgs) (error) {
 		// Check for server errors
 		if replies[index].Error != nil {
 			//fmt.Printf("Write failed on server %2d\n", GetServerNumberFromString(hostname))
-			return fmt.Errorf("%s: Remote error on server %2d: %v\n", remoteFunction, index, replies[index].Error)
+			return fmt.Errorf("%s: Remote error on server %2d: %v\n", remoteFunction, replicas[index], replies[index].Error)
 		} else {
 			responses++
 		}
 	}
 
-	if responses >= 4 {
+	if len(replicas) > 0 && responses == len(replicas) {
 		fmt.Printf("Write successful\n")
 	} else {
 		return fmt.Errorf("Only wrote to %d replicas\n", responses)
@@ -169,8 +152,8 @@ func RemoteGetAndGetVersions(remoteFunction string, remoteArgs shared.FileArgs)
 	var replies = make([]*rpc.Call, len(replicas))
 
 	// Call the remote servers
-	for index, address := range replicas {
-		conn, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", address, shared.FilePort))
+	for index, server := range replicas {
+		conn, err := shared.DialRPC(server, fileEndpoint(server), shared.FileRPCTraffic)
 
 		// The server is unable to be reached
 		if err != nil {
@@ -215,14 +198,13 @@ func RemoteGetAndGetVersions(remoteFunction string, remoteArgs shared.FileArgs)
 }
 
 func RemoteDeleteAndLS(remoteFunction string, remoteArgs shared.FileArgs) (error) {
-	const NumServs = shared.NumServers
-	var calls [NumServs+1]*rpc.Call
-	var replies [NumServs+1]*rpc.Call
+	servers := shared.GetServerNumbers()
+	var calls = make([]*rpc.Call, len(servers))
+	var replies = make([]*rpc.Call, len(servers))
 
 	// Call the remote servers
-	for i := 1; i <= NumServs; i++ {
-		serverAddress := shared.GetServerAddressFromNumber(i)
-		conn, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", serverAddress, shared.FilePort))
+	for i, server := range servers {
+		conn, err := shared.DialRPC(server, fileEndpoint(server), shared.FileRPCTraffic)
 
 		// The server is unable to be reached, but that doesn't matter, because that machine doesn't have the file
 		if err != nil {
@@ -234,7 +216,7 @@ func RemoteDeleteAndLS(remoteFunction string, remoteArgs shared.FileArgs) (error
 	}
 
 	// Collect the responses
-	for i := 1; i <= NumServs; i++ {
+	for i, server := range servers {
 		if calls[i] == nil {
 			continue
 		}
@@ -243,20 +225,19 @@ func RemoteDeleteAndLS(remoteFunction string, remoteArgs shared.FileArgs) (error
 
 		// Check for server errors
 		if replies[i].Error != nil {
-			return fmt.Errorf("%sRemote error on server %2d: %v\n", remoteFunction, i, replies[i].Error)
+			return fmt.Errorf("%sRemote error on server %2d: %v\n", remoteFunction, server, replies[i].Error)
 		}
 		if onMachine {
-			fmt.Printf("Server %2d\n", i)
+			fmt.Printf("Server %2d\n", server)
 		}
 	}
 	return nil
 }
 
-func RemoteSendFile(sdfsFname string, contents []byte, server int) (error) {
-	hostname := shared.GetServerAddressFromNumber(server)
-	remoteArgs := shared.FileArgs{"", sdfsFname, contents, 0}
+func RemoteSendFile(sdfsFname string, contents []byte, modTime time.Time, server int) (error) {
+	remoteArgs := shared.ReplicaArgs{SdfsFname: sdfsFname, FileContents: contents, ModTime: modTime}
 
-	conn, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", hostname, shared.FilePort))
+	conn, err := shared.DialRPC(server, fileEndpoint(server), shared.FileRPCTraffic)
 
 	if err != nil {
 		return err
@@ -277,7 +258,7 @@ func openFilePortForRPC() {
 	remoteFile := new(RemoteFile)
 	server := rpc.NewServer()
 	server.Register(remoteFile)
-	l, e := net.Listen("tcp", fmt.Sprintf(":%d", shared.FilePort))
+	l, e := net.Listen("tcp", fmt.Sprintf(":%d", shared.OwnNode().Ports.File))
 	if e != nil {
 		log.Fatal("Error trying to listen for RemoteFile RPC calls: ", e)
 	}
@@ -287,7 +268,7 @@ func openFilePortForRPC() {
 func openFilePortForRPCInGoRoutine() {
 	remoteFile := new(RemoteFile)
 	rpc.Register(remoteFile)
-	listener, lisErr := net.Listen("tcp", fmt.Sprintf(":%d", shared.FilePort))
+	listener, lisErr := net.Listen("tcp", fmt.Sprintf(":%d", shared.OwnNode().Ports.File))
 	if lisErr != nil {
 		log.Fatal("Error trying to listen for RemoteFile RPC calls: ", lisErr)
 	}
@@ -298,6 +279,6 @@ func openFilePortForRPCInGoRoutine() {
 			return
     }
 
-    go rpc.ServeConn(conn)
+    go shared.ServeRPCConn(conn, shared.FileRPCTraffic)
   }
 }
@@ -0,0 +1,137 @@
+package file_sys
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	fileSysLog = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// Returns a new empty folder standing in for a server's SDFS folder
+func holderDir(t *testing.T) string {
+	dir, dirErr := ioutil.TempDir("", "sdfs")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	return dir + "/"
+}
+
+// Sends every file and version in the holder's folder to the new holder, the way sendReplica does
+func sendAll(t *testing.T, holder, newHolder string) {
+	files, readErr := ioutil.ReadDir(holder)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	for _, f := range files {
+		contents, _ := ioutil.ReadFile(holder + f.Name())
+		if receiveErr := ReceiveFile(newHolder+f.Name(), contents, f.ModTime()); receiveErr != nil {
+			t.Fatal(receiveErr)
+		}
+	}
+}
+
+// Returns the contents of every file in the folder by name
+func folderContents(t *testing.T, dir string) map[string]string {
+	files, readErr := ioutil.ReadDir(dir)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	contents := map[string]string{}
+	for _, f := range files {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		contents[f.Name()] = string(data)
+	}
+	return contents
+}
+
+func sameContents(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, data := range a {
+		if have, ok := b[name]; !ok || have != data {
+			return false
+		}
+	}
+	return true
+}
+
+type put struct {
+	contents string
+	at       time.Time
+}
+
+func TestReceiveFileMerge(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	v1 := put{"v1", start}
+	v2 := put{"v2", start.Add(time.Minute)}
+	a := put{"written on side a", start.Add(2 * time.Minute)}
+	b := put{"written on side b", start.Add(3 * time.Minute)}
+
+	tests := []struct {
+		name string
+		// The puts each holder saw, oldest first
+		holders [][]put
+		want    map[string]string
+	}{
+		{"re-replicating from every old holder",
+			[][]put{{v1, v2}, {v1, v2}, {v1, v2}},
+			map[string]string{"foo": "v2", "foo~1": "v1"}},
+		{"reconciling both sides of a partition",
+			[][]put{{v1, a}, {v1, b}},
+			map[string]string{"foo": b.contents, "foo~1": a.contents, "foo~2": "v1"}},
+		{"a holder that missed a put",
+			[][]put{{v1}, {v1, v2}},
+			map[string]string{"foo": "v2", "foo~1": "v1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newHolder := holderDir(t)
+			defer os.RemoveAll(newHolder)
+			for _, puts := range test.holders {
+				holder := holderDir(t)
+				defer os.RemoveAll(holder)
+				for _, p := range puts {
+					if putErr := PutFile("local", holder+"foo", []byte(p.contents), p.at); putErr != nil {
+						t.Fatal(putErr)
+					}
+				}
+				sendAll(t, holder, newHolder)
+			}
+			if got := folderContents(t, newHolder); !sameContents(got, test.want) {
+				t.Errorf("new holder has %v, want %v", got, test.want)
+			}
+
+			// Sending everything again changes nothing
+			sendAll(t, newHolder, newHolder)
+			if got := folderContents(t, newHolder); !sameContents(got, test.want) {
+				t.Errorf("after sending again, new holder has %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReceiveFileKeepsNewestVersions(t *testing.T) {
+	dir := holderDir(t)
+	defer os.RemoveAll(dir)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < maxNumVersions+3; i++ {
+		if receiveErr := ReceiveFile(dir+"foo", []byte{byte('a' + i)}, start.Add(time.Duration(i)*time.Minute)); receiveErr != nil {
+			t.Fatal(receiveErr)
+		}
+	}
+	got := folderContents(t, dir)
+	if len(got) != maxNumVersions+1 {
+		t.Errorf("kept %d versions, want %d", len(got), maxNumVersions+1)
+	}
+	if newest := string([]byte{byte('a' + maxNumVersions + 2)}); got["foo"] != newest {
+		t.Errorf("foo is %q, want the newest version %q", got["foo"], newest)
+	}
+}
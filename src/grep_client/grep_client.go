@@ -9,8 +9,6 @@ import (
 	"strings"
 )
 
-const NumServs = shared.NumServers
-
 // TODO: add a timeout for the server
 func main() {
 	// Parse the command line arguments
@@ -19,8 +17,45 @@ func main() {
 	patternPtr := flag.String("pattern", "", "Search criteria. Wrap in quotes to use wildcards")
 	verbosePtr := flag.Bool("verbose", false, "Print debugging info")
 	outputFilePtr := flag.String("output_file", "", "Name of the file to output to")
+	configPtr := flag.String("config", "cluster.json", "Cluster config file listing the servers to grep")
+	localPtr := flag.Int("local", 0, "Grep this many servers running in local mode instead of using the config file")
+	basePortPtr := flag.Int("base_port", 7000, "First port of the port blocks used in local mode")
+	wherePtr := flag.String("where", "", "Only grep alive servers whose metadata matches, like \"role=storage,zone=a\"")
 	flag.Parse()
 
+	var configErr error
+	if *localPtr > 0 {
+		configErr = shared.SetConfig(shared.LocalConfig(*localPtr, *basePortPtr))
+	} else {
+		configErr = shared.LoadConfig(*configPtr)
+	}
+	if configErr != nil {
+		fmt.Printf("%v\n", configErr)
+		os.Exit(1)
+	}
+	servers := shared.GetServerNumbers()
+
+	// Filter the servers by the metadata the cluster advertises
+	if *wherePtr != "" {
+		filters, filterErr := shared.ParseMetadataFilters(*wherePtr)
+		if filterErr != nil {
+			fmt.Printf("%v\n", filterErr)
+			os.Exit(1)
+		}
+		metadata, metaErr := fetchMetadata(servers)
+		if metaErr != nil {
+			fmt.Printf("%v\n", metaErr)
+			os.Exit(1)
+		}
+		var matching []int
+		for _, server := range servers {
+			if meta, ok := metadata[server]; ok && shared.MetadataMatches(meta, filters) {
+				matching = append(matching, server)
+			}
+		}
+		servers = matching
+	}
+
 	// Open an output file
 	var outfile *os.File
 	var err error
@@ -32,53 +67,75 @@ func main() {
 	}
 	defer outfile.Close()
 
-	var calls [NumServs]*rpc.Call
-	var replies [NumServs]*rpc.Call
-	var lengths [NumServs]int
+	var calls = make([]*rpc.Call, len(servers))
+	var replies = make([]*rpc.Call, len(servers))
+	var lengths = make([]int, len(servers))
 
 	// Call the remote servers
-	for i := 1; i <= NumServs; i++ {
-		serverAddress := shared.GetServerAddressFromNumber(i)
-
-		conn, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", serverAddress, shared.GrepServerPort))
+	for i, server := range servers {
+		node := shared.GetNode(server)
+		conn, err := shared.DialRPC(server, node.Endpoint(node.Ports.Grep), shared.GrepRPCTraffic)
 
 		// Call the server if connection was successful
 		if err != nil {
-			fmt.Printf("DIAL ERROR on server %2d: %v\n", i, err)
-			lengths[i-1] = -1
+			fmt.Printf("DIAL ERROR on server %2d: %v\n", server, err)
+			lengths[i] = -1
 		} else {
-			args := &shared.GrepArgs_t{strings.Fields(*grepArgsPtr), *fileGlobPtr, *patternPtr, *verbosePtr}
+			args := &shared.GrepArgs_t{GrepArgs: strings.Fields(*grepArgsPtr), FileGlob: *fileGlobPtr, Pattern: *patternPtr, Verbose: *verbosePtr}
 			var reply shared.GrepReply_t
-			calls[i-1] = conn.Go("GrepLogger.Grep", args, &reply, nil)
+			calls[i] = conn.Go("GrepLogger.Grep", args, &reply, nil)
 		}
 	}
 
 	// Collect the responses
-	for i := 1; i <= NumServs; i++ {
-		if lengths[i-1] >= 0 {
-			replies[i-1] = <-calls[i-1].Done
+	for i, server := range servers {
+		if lengths[i] >= 0 {
+			replies[i] = <-calls[i].Done
 
 			// Check for server errors
-			if replies[i-1].Error != nil {
-				fmt.Printf("GREP ERROR on server %2d: %v\n", i, replies[i-1].Error)
-				lengths[i-1] = -1
+			if replies[i].Error != nil {
+				fmt.Printf("GREP ERROR on server %2d: %v\n", server, replies[i].Error)
+				lengths[i] = -1
 			}
 
 			// Print the lines and record counts
-			if lengths[i-1] >= 0 {
-				lengths[i-1] = replies[i-1].Reply.(*shared.GrepReply_t).NumLines
-				fmt.Print(replies[i-1].Reply.(*shared.GrepReply_t).Out)
+			if lengths[i] >= 0 {
+				lengths[i] = replies[i].Reply.(*shared.GrepReply_t).NumLines
+				fmt.Print(replies[i].Reply.(*shared.GrepReply_t).Out)
 			}
 		}
 	}
 
 	// Print line counts
 	var total = 0
-	for i := 1; i <= NumServs; i++ {
-		if lengths[i-1] >= 0 {
-			total += lengths[i-1]
-			fmt.Printf("Server %2d has %6d lines.\n", i, lengths[i-1])
+	for i, server := range servers {
+		if lengths[i] >= 0 {
+			total += lengths[i]
+			fmt.Printf("Server %2d has %6d lines.\n", server, lengths[i])
 		}
 	}
 	fmt.Printf("The total number of lines is %d.\n", total)
 }
+
+// Asks the servers in turn for the metadata of every alive server, until one answers
+func fetchMetadata(servers []int) (map[int]map[string]string, error) {
+	for _, server := range servers {
+		node := shared.GetNode(server)
+		conn, err := shared.DialRPC(server, node.Endpoint(node.Ports.Grep), shared.GrepRPCTraffic)
+		if err != nil {
+			continue
+		}
+		var reply shared.MetadataReply
+		err = conn.Call("Membership.Metadata", &shared.MetadataArgs{}, &reply)
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		metadata := map[int]map[string]string{}
+		for _, server := range reply.Servers {
+			metadata[server.ServNum] = server.Meta
+		}
+		return metadata, nil
+	}
+	return nil, fmt.Errorf("couldn't get the metadata from any server")
+}
@@ -28,8 +28,8 @@ func (t *GrepLogger) Grep(args *shared.GrepArgs_t, reply *shared.GrepReply_t) er
 func GrepHelp(grepArgs []string, fileGlob, pattern string, verbose bool, reply *shared.GrepReply_t) error {
 	grepLogObj := shared.OpenLogFile("machineLog.log")
 
-	// Get the files, interpreting the file string as a shell glob
-	files, globErr := filepath.Glob(fileGlob)
+	// Get the files, interpreting the file string as a shell glob relative to our log folder
+	files, globErr := filepath.Glob(shared.LogPath(fileGlob))
 	if globErr != nil {
 		return errors.New(fmt.Sprintf("%s: %v\n", globErr.Error(), fileGlob))
 	} else if len(files) == 0 {
@@ -90,7 +90,7 @@ func GrepHelp(grepArgs []string, fileGlob, pattern string, verbose bool, reply *
 func openGrepPortForRPC() {
 	grepLogger := new(GrepLogger)
 	rpc.Register(grepLogger)
-	listener, lisErr := net.Listen("tcp", fmt.Sprintf(":%d", shared.GrepServerPort))
+	listener, lisErr := net.Listen("tcp", fmt.Sprintf(":%d", shared.OwnNode().Ports.Grep))
 	if lisErr != nil {
 		log.Fatal("grep listen error: ", lisErr)
 	}
@@ -101,7 +101,7 @@ func openGrepPortForRPC() {
 			return
     }
 
-    go rpc.ServeConn(conn)
+    go shared.ServeRPCConn(conn, shared.GrepRPCTraffic)
   }
 }
 
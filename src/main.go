@@ -4,29 +4,91 @@ import (
 	"bufio"
 	"failure"
 	"file_sys"
+	"flag"
 	"fmt"
 	"grep_server"
 	"log"
 	"os"
 	"os/exec"
 	"shared"
+	"strconv"
 	"strings"
 )
 
 const CMD_PROMPT = "> "
 
 func main() {
+	configPtr := flag.String("config", "cluster.json", "Cluster config file describing every node")
+	localPtr := flag.Int("local", 0, "Run as one of this many nodes on this machine instead of using the config file")
+	basePortPtr := flag.Int("base_port", 7000, "First port of the port blocks used in local mode")
+	idPtr := flag.Int("id", 0, "Which node this is. Required in local mode, otherwise found from the hostname")
+	seedsPtr := flag.String("seeds", "", "Comma separated ids of the nodes to ask to join, in order, overriding the cluster config")
+	clusterKeyPtr := flag.String("cluster_key", "", "Secret used to sign failure detector messages, overriding the cluster config")
+	insecurePtr := flag.Bool("insecure", false, "Start even without a cluster key, so anyone can forge failure detector messages")
+	detectorPtr := flag.String("detector", "", "Failure detector to use (ping, alltoall, gossip or phi), overriding the cluster config")
+	probingPtr := flag.String("probing", "", "How the ping detector picks whom to ping (finger or roundrobin), overriding the cluster config")
+	flag.Parse()
+
 	println("Starting server")
 	log.SetFlags(log.Lshortfile)
 
+	var configErr error
+	if *localPtr > 0 {
+		if *idPtr == 0 {
+			log.Fatal("-id is required with -local")
+		}
+		configErr = shared.SetConfig(shared.LocalConfig(*localPtr, *basePortPtr))
+	} else {
+		configErr = shared.LoadConfig(*configPtr)
+	}
+	if configErr != nil {
+		log.Fatal(configErr)
+	}
+	if *detectorPtr != "" {
+		shared.Config.Failure.Detector = *detectorPtr
+	}
+	if *probingPtr != "" {
+		shared.Config.Failure.Probing = *probingPtr
+	}
+	if *clusterKeyPtr != "" {
+		shared.Config.ClusterKey = *clusterKeyPtr
+	}
+	if shared.Config.ClusterKey == "" && !*insecurePtr {
+		log.Fatal("No ClusterKey in the cluster config. Set one there or with -cluster_key, or start with -insecure to run without one")
+	}
+	if *seedsPtr != "" {
+		var seeds []int
+		for _, seedStr := range strings.Split(*seedsPtr, ",") {
+			seed, seedErr := strconv.Atoi(seedStr)
+			if seedErr != nil || shared.GetNode(seed) == nil {
+				log.Fatalf("seed %s is not a node in the cluster", seedStr)
+			}
+			seeds = append(seeds, seed)
+		}
+		shared.Config.Seeds = seeds
+	}
+	if *idPtr != 0 {
+		if idErr := shared.SetOwnServerNumber(*idPtr); idErr != nil {
+			log.Fatal(idErr)
+		}
+	} else {
+		// Look ourselves up by hostname before anything else runs, since every goroutine asks
+		shared.GetOwnServerNumber()
+	}
+
+	go shared.ServeMetrics()
 	failure.Initialize()
 
 	go func() {
 		println("Type 'help' for list of commands")
 		fmt.Printf("[Server %d]%s", shared.GetOwnServerNumber(), CMD_PROMPT)
+		reader := bufio.NewReader(os.Stdin)
 		for {
-			reader := bufio.NewReader(os.Stdin)
-			cmd, _ := reader.ReadString('\n')
+			cmd, readErr := reader.ReadString('\n')
+			// Stdin is closed when running in the background, so there are no commands to read
+			if readErr != nil {
+				return
+			}
 			go func() {
 				HandleServerCommand(strings.TrimSuffix(cmd, "\n"))
 				fmt.Printf("[Server %d]%s", shared.GetOwnServerNumber(), CMD_PROMPT)
@@ -39,8 +101,7 @@ func main() {
 
 	println("Finished starting server")
 	// Keep the program running so it doesn't close the port
-	for {
-	}
+	select {}
 }
 
 func HandleServerCommand(cmd string) {
@@ -49,15 +110,80 @@ func HandleServerCommand(cmd string) {
 		println()
 	}
 	case "leave": {
+		// Hand off our files while we are still a replica, so there is never one copy too few
+		if handoffErr := file_sys.Leave(); handoffErr != nil {
+			fmt.Printf("%v\n", handoffErr)
+			if len(com) < 2 || com[1] != "force" {
+				fmt.Println("Not leaving, use 'leave force' to leave anyway")
+				return
+			}
+		}
 		fmt.Println("Leaving group")
-		failure.LeaveGroup()
-		file_sys.Leave()
+		failure.Detector.Leave()
+	}
+	case "fault": {
+		if faultErr := shared.HandleFaultCmd(com[1:]); faultErr != nil {
+			fmt.Printf("%v\n", faultErr)
+		}
 	}
 	case "print_fail": {
 		shared.PrintFailDetectInfo = !shared.PrintFailDetectInfo
 	}
+	case "traffic": {
+		fmt.Print(shared.TrafficStr(len(com) > 1 && com[1] == "peers"))
+	}
+	case "history": {
+		if len(com) < 2 {
+			fmt.Print(failure.HistoryStr())
+			break
+		}
+		servNum, parseErr := strconv.Atoi(com[1])
+		if parseErr != nil || shared.GetNode(servNum) == nil {
+			fmt.Printf("%s is not a server in the cluster\n", com[1])
+			break
+		}
+		fmt.Print(failure.GatherHistoryStr(servNum))
+	}
+	case "converge": {
+		fmt.Print(failure.ConvergenceStr())
+	}
+	case "meta": {
+		switch {
+		case len(com) == 1:
+			fmt.Print(failure.MetadataStr(0))
+		case com[1] == "set" && len(com) >= 4:
+			if setErr := failure.SetMetadata(com[2], strings.Join(com[3:], " ")); setErr != nil {
+				fmt.Printf("%v\n", setErr)
+			}
+		case com[1] == "unset" && len(com) == 3:
+			if setErr := failure.SetMetadata(com[2], ""); setErr != nil {
+				fmt.Printf("%v\n", setErr)
+			}
+		case com[1] == "where" && len(com) == 3:
+			filters, filterErr := shared.ParseMetadataFilters(com[2])
+			if filterErr != nil {
+				fmt.Printf("%v\n", filterErr)
+				break
+			}
+			fmt.Printf("Alive servers matching %s: %v\n", com[2], failure.ServersWithMetadata(filters))
+		default:
+			servNum, parseErr := strconv.Atoi(com[1])
+			if parseErr != nil || shared.GetNode(servNum) == nil {
+				fmt.Println("Usage: meta [SERVER], meta set KEY VALUE, meta unset KEY, or meta where KEY=VALUE[,KEY=VALUE...]")
+				break
+			}
+			fmt.Print(failure.MetadataStr(servNum))
+		}
+	}
+	case "health": {
+		fmt.Print(failure.HealthStr())
+	}
 	case "memlist": {
 		println(failure.MemList.Str(true))
+		fmt.Print(failure.MemList.RTTStr())
+		if failure.PartitionSuspected() {
+			fmt.Printf("The network looks partitioned, in the minority: %v\n", failure.InMinority())
+		}
 	}
 	case "clear" : {
     cmd := exec.Command("clear")
@@ -72,7 +198,7 @@ func HandleServerCommand(cmd string) {
 		println()
 	}
 	case "help": {
-		fmt.Printf("leave\nprint_fail\nmem_list\nput\nget\ndelete\nls\nstore\nget-versions\n\n")
+		fmt.Printf("leave\nprint_fail\nmemlist\nhistory\nconverge\nmeta\nhealth\ntraffic\nfault\nput\nget\ndelete\nls\nstore\nget-versions\n\n")
 	}
 	default:
 		println("Invalid Command")
@@ -0,0 +1,380 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ports every node listens on
+type Ports struct {
+	Grep       int
+	Ping       int
+	ACK        int
+	Introducer int
+	File       int
+	// Serves the traffic counters over HTTP for Prometheus
+	Metrics int
+}
+
+// Describes a single node in the cluster.
+// Ports and folders left empty are taken from the cluster wide values.
+type NodeConfig struct {
+	Id      int
+	Address string
+	Ports   Ports
+	DataDir string
+	LogDir  string
+	// Advertised to the other nodes along with the membership list, like role, zone or capacity
+	Metadata map[string]string
+}
+
+// Settings for the failure detector
+type FailureConfig struct {
+	// How failures are found: "ping" (the default), "alltoall", "gossip" or "phi"
+	Detector string
+	// How the ping detector picks whom to ping each round: "finger" (the default) for the finger table,
+	// or "roundrobin" to go through every server in a shuffled order
+	Probing string
+	// How long a server stays suspected before it is declared failed
+	SuspicionTimeout Duration
+	// Each membership update is piggybacked on RetransmitMult * log(n) pings
+	RetransmitMult int
+	// The most updates piggybacked on a single ping
+	MaxPiggyback int
+	// How often heartbeats are sent by the alltoall and gossip detectors
+	HeartbeatInterval Duration
+	// How long a heartbeat can stay the same before the server is suspected
+	HeartbeatTimeout Duration
+	// How many random servers the gossip detector sends to each round
+	GossipFanout int
+	// The phi detector suspects a server once phi goes over this
+	PhiThreshold float64
+	// How many of the latest gaps between ACKs the phi detector remembers
+	PhiWindow int
+	// A partition is assumed when at least PartitionFraction of the group fails within PartitionWindow
+	PartitionFraction float64
+	PartitionWindow   Duration
+	// Stop moving SDFS replicas around while on the smaller side of a partition
+	SuspendReplicationInMinority bool
+	// How often to offer a failed server to merge membership lists, in case it is only partitioned
+	MergeInterval Duration
+	// How long failed and left servers are remembered before they are dropped from the membership list
+	TombstoneExpiry Duration
+	// A server's ACK timeout is the mean round trip time plus RTTMultiplier standard deviations, kept between the bounds
+	MinACKTimeout Duration
+	MaxACKTimeout Duration
+	RTTMultiplier float64
+	// The ping interval is three times the longest ACK timeout, kept between the bounds
+	MinPingInterval Duration
+	MaxPingInterval Duration
+	// How often the membership list is saved, so a restarted server can rejoin through the servers it knew
+	SnapshotInterval Duration
+	// How many membership changes are kept in the history
+	HistoryLength int
+	// The highest the local health score goes. Timeouts are stretched by the score plus one.
+	MaxLocalHealth int
+}
+
+// Describes the whole cluster, loaded from a JSON file at startup
+type ClusterConfig struct {
+	Nodes []NodeConfig
+	Ports Ports
+	// Nodes that new members ask to join, in order. Introducer is the only seed if this is empty.
+	Seeds      []int
+	Introducer int
+	DataDir    string
+	LogDir     string
+	Failure    FailureConfig
+	// Secret every node signs its failure detector messages with, so outsiders can't forge them
+	ClusterKey string
+}
+
+// A time.Duration that is written like "1.5s" in the config file
+type Duration struct {
+	time.Duration
+}
+
+// Address every node uses in local mode
+const LocalAddress = "127.0.0.1"
+
+// Number of ports set aside for each node in local mode
+const LocalPortBlockSize = 10
+
+// The cluster config that every package reads from
+var Config ClusterConfig
+
+var ownServerNum = 0
+
+// Returns "address:port" for this node
+func (node *NodeConfig) Endpoint(port int) string {
+	return net.JoinHostPort(node.Address, strconv.Itoa(port))
+}
+
+// Reads the cluster config from the given JSON file and makes it the active config
+func LoadConfig(path string) error {
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return fmt.Errorf("could not read cluster config: %v", readErr)
+	}
+
+	var config ClusterConfig
+	if jsonErr := json.Unmarshal(data, &config); jsonErr != nil {
+		return fmt.Errorf("could not parse cluster config %s: %v", path, jsonErr)
+	}
+	return SetConfig(config)
+}
+
+// Validates the config, fills in the defaults, and makes it the active config
+func SetConfig(config ClusterConfig) error {
+	if len(config.Nodes) == 0 {
+		return fmt.Errorf("cluster config has no nodes")
+	}
+
+	seen := map[int]bool{}
+	for _, node := range config.Nodes {
+		if node.Id < 1 {
+			return fmt.Errorf("node id %d is not a positive number", node.Id)
+		}
+		if seen[node.Id] {
+			return fmt.Errorf("node id %d is listed more than once", node.Id)
+		}
+		if node.Address == "" {
+			return fmt.Errorf("node %d has no address", node.Id)
+		}
+		if metaErr := CheckMetadata(node.Metadata); metaErr != nil {
+			return fmt.Errorf("node %d: %v", node.Id, metaErr)
+		}
+		for _, key := range []string{MetaAddress, MetaGrepPort, MetaFilePort, MetaMetricsPort} {
+			if _, ok := node.Metadata[key]; ok {
+				return fmt.Errorf("node %d: metadata can't set %s, it comes from the node's address and ports", node.Id, key)
+			}
+		}
+		seen[node.Id] = true
+	}
+
+	if config.Introducer == 0 {
+		config.Introducer = config.Nodes[0].Id
+	}
+	if !seen[config.Introducer] {
+		return fmt.Errorf("introducer %d is not one of the nodes", config.Introducer)
+	}
+	if len(config.Seeds) == 0 {
+		config.Seeds = []int{config.Introducer}
+	}
+	for _, seed := range config.Seeds {
+		if !seen[seed] {
+			return fmt.Errorf("seed %d is not one of the nodes", seed)
+		}
+	}
+
+	// Any port left out of the file uses the default
+	config.Ports.fillFrom(Ports{GrepServerPort, SwimPingPort, SwimACKPort, SwimIntroducerPort, FilePort, MetricsPort})
+	if config.DataDir == "" {
+		config.DataDir = DefaultDataDir
+	}
+	config.DataDir = withTrailingSlash(config.DataDir)
+	config.LogDir = withTrailingSlash(config.LogDir)
+
+	if config.Failure.SuspicionTimeout.Duration <= 0 {
+		config.Failure.SuspicionTimeout.Duration = DefaultSuspicionTimeout
+	}
+	if config.Failure.RetransmitMult <= 0 {
+		config.Failure.RetransmitMult = DefaultRetransmitMult
+	}
+	if config.Failure.MaxPiggyback <= 0 {
+		config.Failure.MaxPiggyback = DefaultMaxPiggyback
+	}
+	if config.Failure.HeartbeatInterval.Duration <= 0 {
+		config.Failure.HeartbeatInterval.Duration = DefaultHeartbeatInterval
+	}
+	if config.Failure.HeartbeatTimeout.Duration <= 0 {
+		config.Failure.HeartbeatTimeout.Duration = DefaultHeartbeatTimeout
+	}
+	if config.Failure.GossipFanout <= 0 {
+		config.Failure.GossipFanout = DefaultGossipFanout
+	}
+	if config.Failure.PhiThreshold <= 0 {
+		config.Failure.PhiThreshold = DefaultPhiThreshold
+	}
+	if config.Failure.PhiWindow <= 0 {
+		config.Failure.PhiWindow = DefaultPhiWindow
+	}
+	if config.Failure.PartitionFraction <= 0 {
+		config.Failure.PartitionFraction = DefaultPartitionFraction
+	}
+	if config.Failure.PartitionWindow.Duration <= 0 {
+		config.Failure.PartitionWindow.Duration = DefaultPartitionWindow
+	}
+	if config.Failure.MergeInterval.Duration <= 0 {
+		config.Failure.MergeInterval.Duration = DefaultMergeInterval
+	}
+	if config.Failure.TombstoneExpiry.Duration <= 0 {
+		config.Failure.TombstoneExpiry.Duration = DefaultTombstoneExpiry
+	}
+	if config.Failure.MinACKTimeout.Duration <= 0 {
+		config.Failure.MinACKTimeout.Duration = DefaultMinACKTimeout
+	}
+	if config.Failure.MaxACKTimeout.Duration <= 0 {
+		config.Failure.MaxACKTimeout.Duration = DefaultMaxACKTimeout
+	}
+	if config.Failure.RTTMultiplier <= 0 {
+		config.Failure.RTTMultiplier = DefaultRTTMultiplier
+	}
+	if config.Failure.MinPingInterval.Duration <= 0 {
+		config.Failure.MinPingInterval.Duration = DefaultMinPingInterval
+	}
+	if config.Failure.MaxPingInterval.Duration <= 0 {
+		config.Failure.MaxPingInterval.Duration = DefaultMaxPingInterval
+	}
+	if config.Failure.SnapshotInterval.Duration <= 0 {
+		config.Failure.SnapshotInterval.Duration = DefaultSnapshotInterval
+	}
+	if config.Failure.HistoryLength <= 0 {
+		config.Failure.HistoryLength = DefaultHistoryLength
+	}
+	if config.Failure.MaxLocalHealth <= 0 {
+		config.Failure.MaxLocalHealth = DefaultMaxLocalHealth
+	}
+	if config.Failure.MinACKTimeout.Duration > config.Failure.MaxACKTimeout.Duration {
+		return fmt.Errorf("MinACKTimeout %v is longer than MaxACKTimeout %v", config.Failure.MinACKTimeout.Duration, config.Failure.MaxACKTimeout.Duration)
+	}
+	if config.Failure.MinPingInterval.Duration > config.Failure.MaxPingInterval.Duration {
+		return fmt.Errorf("MinPingInterval %v is longer than MaxPingInterval %v", config.Failure.MinPingInterval.Duration, config.Failure.MaxPingInterval.Duration)
+	}
+	// A round has to last until a server that hasn't been timed yet could be suspected
+	if config.Failure.MaxPingInterval.Duration < 2*config.Failure.MaxACKTimeout.Duration {
+		return fmt.Errorf("MaxPingInterval %v is shorter than twice MaxACKTimeout %v, so rounds would overlap", config.Failure.MaxPingInterval.Duration, config.Failure.MaxACKTimeout.Duration)
+	}
+
+	for i := range config.Nodes {
+		node := &config.Nodes[i]
+		node.Ports.fillFrom(config.Ports)
+		if node.DataDir == "" {
+			node.DataDir = config.DataDir
+		}
+		if node.LogDir == "" {
+			node.LogDir = config.LogDir
+		}
+		node.DataDir = withTrailingSlash(node.DataDir)
+		node.LogDir = withTrailingSlash(node.LogDir)
+	}
+
+	Config = config
+	ownServerNum = 0
+	return nil
+}
+
+// Builds a config for running numNodes nodes on this machine.
+// Node i gets the block of ports starting at basePort + i*LocalPortBlockSize and its own folders under local/.
+func LocalConfig(numNodes, basePort int) ClusterConfig {
+	var config ClusterConfig
+	for i := 1; i <= numNodes; i++ {
+		start := basePort + i*LocalPortBlockSize
+		config.Nodes = append(config.Nodes, NodeConfig{
+			Id:      i,
+			Address: LocalAddress,
+			Ports:   Ports{Grep: start, Ping: start + 1, ACK: start + 2, Introducer: start + 3, File: start + 4, Metrics: start + 5},
+			DataDir: fmt.Sprintf("local/node%d/%s", i, DefaultDataDir),
+			LogDir:  fmt.Sprintf("local/node%d/", i),
+		})
+	}
+	config.Introducer = 1
+	return config
+}
+
+// Tells this process which node it is, instead of matching on hostname
+func SetOwnServerNumber(servNum int) error {
+	if GetNode(servNum) == nil {
+		return fmt.Errorf("node %d is not in the cluster config", servNum)
+	}
+	ownServerNum = servNum
+	return nil
+}
+
+// Returns the config entry for the given server, or nil if it isn't in the cluster
+func GetNode(servNum int) *NodeConfig {
+	for i := range Config.Nodes {
+		if Config.Nodes[i].Id == servNum {
+			return &Config.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// Returns the config entry for the machine this process is running on
+func OwnNode() *NodeConfig {
+	return GetNode(GetOwnServerNumber())
+}
+
+// Returns the numbers of every server in the cluster config
+func GetServerNumbers() (servNums []int) {
+	for _, node := range Config.Nodes {
+		servNums = append(servNums, node.Id)
+	}
+	return
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if jsonErr := json.Unmarshal(data, &str); jsonErr != nil {
+		return fmt.Errorf("durations should be strings like \"1.5s\": %v", jsonErr)
+	}
+	parsed, parseErr := time.ParseDuration(str)
+	if parseErr != nil {
+		return parseErr
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// Fills in any ports that are zero from the defaults
+func (ports *Ports) fillFrom(defaults Ports) {
+	if ports.Grep == 0 {
+		ports.Grep = defaults.Grep
+	}
+	if ports.Ping == 0 {
+		ports.Ping = defaults.Ping
+	}
+	if ports.ACK == 0 {
+		ports.ACK = defaults.ACK
+	}
+	if ports.Introducer == 0 {
+		ports.Introducer = defaults.Introducer
+	}
+	if ports.File == 0 {
+		ports.File = defaults.File
+	}
+	if ports.Metrics == 0 {
+		ports.Metrics = defaults.Metrics
+	}
+}
+
+func withTrailingSlash(dir string) string {
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return dir
+}
+
+// Figures out which node we are by matching the hostname against the config
+func lookupOwnServerNumber() int {
+	hostname, hostErr := os.Hostname()
+	if hostErr != nil {
+		panic(fmt.Sprintf("Could not get hostname: %v\n", hostErr))
+	}
+	servNum := GetServerNumberFromString(hostname)
+	if servNum == 0 {
+		panic(fmt.Sprintf("This machine (%s) is not in the cluster config, exiting execution.\n", hostname))
+	}
+	return servNum
+}
@@ -0,0 +1,119 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a config with the given nodes, each on its own address
+func testConfig(ids ...int) ClusterConfig {
+	var config ClusterConfig
+	for _, id := range ids {
+		config.Nodes = append(config.Nodes, NodeConfig{Id: id, Address: fmt.Sprintf("10.0.0.%d", id)})
+	}
+	return config
+}
+
+func TestSetConfigRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(config *ClusterConfig)
+		wantErr string
+	}{
+		{"no nodes", func(config *ClusterConfig) { config.Nodes = nil }, "no nodes"},
+		{"missing address", func(config *ClusterConfig) { config.Nodes[1].Address = "" }, "no address"},
+		{"duplicate id", func(config *ClusterConfig) { config.Nodes[1].Id = 1 }, "more than once"},
+		{"unknown introducer", func(config *ClusterConfig) { config.Introducer = 9 }, "introducer 9"},
+		{"unknown seed", func(config *ClusterConfig) { config.Seeds = []int{1, 9} }, "seed 9"},
+		{"reserved metadata", func(config *ClusterConfig) {
+			config.Nodes[0].Metadata = map[string]string{MetaAddress: "elsewhere"}
+		}, "can't set"},
+		{"ACK timeout bounds swapped", func(config *ClusterConfig) {
+			config.Failure.MinACKTimeout.Duration = time.Second
+			config.Failure.MaxACKTimeout.Duration = 500 * time.Millisecond
+		}, "MinACKTimeout"},
+		{"ping interval bounds swapped", func(config *ClusterConfig) {
+			config.Failure.MinPingInterval.Duration = 5 * time.Second
+			config.Failure.MaxPingInterval.Duration = 3 * time.Second
+		}, "MinPingInterval"},
+		{"rounds shorter than two ACK timeouts", func(config *ClusterConfig) {
+			config.Failure.MaxACKTimeout.Duration = time.Second
+			config.Failure.MaxPingInterval.Duration = 1500 * time.Millisecond
+		}, "MaxPingInterval"},
+	}
+	for _, test := range tests {
+		config := testConfig(1, 2, 3)
+		test.change(&config)
+		err := SetConfig(config)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got error %v, want one mentioning %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestSetConfigDefaults(t *testing.T) {
+	config := testConfig(2, 3)
+	config.Nodes[1].Ports.Ping = 9000
+	config.Nodes[1].DataDir = "/data/sdfs"
+	config.LogDir = "logs"
+	if err := SetConfig(config); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	if Config.Introducer != 2 || len(Config.Seeds) != 1 || Config.Seeds[0] != 2 {
+		t.Errorf("introducer %d and seeds %v, want the first node as both", Config.Introducer, Config.Seeds)
+	}
+	if Config.Failure.SuspicionTimeout.Duration != DefaultSuspicionTimeout || Config.Failure.MaxPingInterval.Duration != DefaultMaxPingInterval {
+		t.Errorf("failure detector settings left empty weren't given the defaults: %+v", Config.Failure)
+	}
+
+	first, second := GetNode(2), GetNode(3)
+	if first.Ports.Ping != SwimPingPort || first.Ports.File != FilePort || second.Ports.Ping != 9000 || second.Ports.Grep != GrepServerPort {
+		t.Errorf("ports are %+v and %+v, want the defaults except where set", first.Ports, second.Ports)
+	}
+	if first.DataDir != DefaultDataDir || second.DataDir != "/data/sdfs/" {
+		t.Errorf("data folders are %q and %q", first.DataDir, second.DataDir)
+	}
+	if first.LogDir != "logs/" || second.LogDir != "logs/" {
+		t.Errorf("log folders are %q and %q, want the cluster wide one", first.LogDir, second.LogDir)
+	}
+}
+
+func TestLocalConfig(t *testing.T) {
+	if err := SetConfig(LocalConfig(3, 7000)); err != nil {
+		t.Fatalf("local config rejected: %v", err)
+	}
+	if Config.Introducer != 1 {
+		t.Errorf("introducer is %d, want 1", Config.Introducer)
+	}
+
+	used := map[int]int{}
+	for _, servNum := range []int{1, 2, 3} {
+		node := GetNode(servNum)
+		if node == nil {
+			t.Fatalf("node %d is missing", servNum)
+		}
+		if node.Address != LocalAddress {
+			t.Errorf("node %d is at %s, want %s", servNum, node.Address, LocalAddress)
+		}
+		start := 7000 + servNum*LocalPortBlockSize
+		want := Ports{Grep: start, Ping: start + 1, ACK: start + 2, Introducer: start + 3, File: start + 4, Metrics: start + 5}
+		if node.Ports != want {
+			t.Errorf("node %d has ports %+v, want %+v", servNum, node.Ports, want)
+		}
+		for _, port := range []int{node.Ports.Grep, node.Ports.Ping, node.Ports.ACK, node.Ports.Introducer, node.Ports.File, node.Ports.Metrics} {
+			if other, taken := used[port]; taken {
+				t.Errorf("port %d is used by nodes %d and %d", port, other, servNum)
+			}
+			used[port] = servNum
+		}
+		if wantDir := fmt.Sprintf("local/node%d/sdfs_files/", servNum); node.DataDir != wantDir {
+			t.Errorf("node %d keeps files in %q, want %q", servNum, node.DataDir, wantDir)
+		}
+		if wantDir := fmt.Sprintf("local/node%d/", servNum); node.LogDir != wantDir {
+			t.Errorf("node %d logs to %q, want %q", servNum, node.LogDir, wantDir)
+		}
+	}
+}
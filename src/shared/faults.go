@@ -0,0 +1,264 @@
+package shared
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults injected into traffic to other servers, so false positives and partitions can be
+// reproduced on demand. Rules are kept per server, and a rule for AllServers applies to any
+// server without its own rule. They only affect this process, but packets and RPC calls that
+// come in from a partitioned server are refused too, so a partition between two servers only
+// needs to be set up on one side. RPC calls are matched to servers by address, so in local mode,
+// where every server shares one, only a partition from every server refuses them.
+
+// How to mess with the traffic to one server
+type FaultRule struct {
+	// Chance of dropping each UDP packet, or failing each RPC dial
+	Drop float64
+	// How long to hold each UDP packet or RPC dial before sending it
+	Delay time.Duration
+	// Chance of sending each UDP packet twice
+	Duplicate float64
+	// Cut off all traffic to and from the server
+	Partitioned bool
+}
+
+// Server number used for the rule that covers every server
+const AllServers = 0
+
+var faultRules = map[int]FaultRule{AllServers: {Drop: FalsePosChance}}
+var faultRulesMutex sync.RWMutex
+
+// Returns the rule that applies to the given server
+func GetFaultRule(servNum int) FaultRule {
+	faultRulesMutex.RLock()
+	defer faultRulesMutex.RUnlock()
+	if rule, ok := faultRules[servNum]; ok {
+		return rule
+	}
+	return faultRules[AllServers]
+}
+
+// Replaces the rule for the given server, or for every server without its own rule if servNum is AllServers
+func SetFaultRule(servNum int, rule FaultRule) {
+	faultRulesMutex.Lock()
+	faultRules[servNum] = rule
+	faultRulesMutex.Unlock()
+}
+
+// Removes every rule, leaving traffic alone
+func ClearFaultRules() {
+	faultRulesMutex.Lock()
+	faultRules = map[int]FaultRule{AllServers: {}}
+	faultRulesMutex.Unlock()
+}
+
+// Returns whether all traffic with the given server is cut off
+func IsPartitioned(servNum int) bool {
+	return GetFaultRule(servNum).Partitioned
+}
+
+// Sends a UDP packet to the given server through the fault rules.
+// send does the actual sending, and may be called zero, one or two times, possibly later on another goroutine.
+func SendWithFaults(servNum int, send func()) {
+	rule := GetFaultRule(servNum)
+	if rule.Partitioned || rand.Float64() < rule.Drop {
+		return
+	}
+	copies := 1
+	if rand.Float64() < rule.Duplicate {
+		copies = 2
+	}
+
+	if rule.Delay <= 0 {
+		for i := 0; i < copies; i++ {
+			send()
+		}
+		return
+	}
+	time.AfterFunc(rule.Delay, func() {
+		for i := 0; i < copies; i++ {
+			send()
+		}
+	})
+}
+
+// Like SendWithFaults, but ignores delay rules and sends before returning,
+// for messages that have to go out before the process exits
+func SendNowWithFaults(servNum int, send func()) {
+	rule := GetFaultRule(servNum)
+	if rule.Partitioned || rand.Float64() < rule.Drop {
+		return
+	}
+	send()
+	if rand.Float64() < rule.Duplicate {
+		send()
+	}
+}
+
+// Dials the RPC server of the given server through the fault rules, counting its traffic as the given kind
+func DialRPC(servNum int, address string, kind string) (*rpc.Client, error) {
+	rule := GetFaultRule(servNum)
+	if rule.Partitioned {
+		return nil, fmt.Errorf("server %d is partitioned off by a fault rule", servNum)
+	}
+	if rand.Float64() < rule.Drop {
+		return nil, fmt.Errorf("dial to server %d dropped by a fault rule", servNum)
+	}
+	time.Sleep(rule.Delay)
+	conn, dialErr := net.Dial("tcp", address)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	return rpc.NewClient(CountConn(conn, kind, servNum)), nil
+}
+
+// Serves RPC calls on a connection we accepted, unless it comes from a server we are partitioned from
+func ServeRPCConn(conn net.Conn, kind string) {
+	peer := PeerFromAddr(conn.RemoteAddr())
+	if IsPartitioned(peer) {
+		conn.Close()
+		return
+	}
+	rpc.ServeConn(CountConn(conn, kind, peer))
+}
+
+func (rule FaultRule) Str() (ret string) {
+	if rule.Partitioned {
+		return "partitioned"
+	}
+	if rule.Drop > 0 {
+		ret += fmt.Sprintf("drop %.2f ", rule.Drop)
+	}
+	if rule.Delay > 0 {
+		ret += fmt.Sprintf("delay %v ", rule.Delay)
+	}
+	if rule.Duplicate > 0 {
+		ret += fmt.Sprintf("dup %.2f ", rule.Duplicate)
+	}
+	if ret == "" {
+		ret = "none"
+	}
+	return strings.TrimSpace(ret)
+}
+
+// Returns every rule, one per line
+func FaultRulesStr() (ret string) {
+	faultRulesMutex.RLock()
+	defer faultRulesMutex.RUnlock()
+
+	var servNums []int
+	for servNum := range faultRules {
+		servNums = append(servNums, servNum)
+	}
+	sort.Ints(servNums)
+	for _, servNum := range servNums {
+		if servNum == AllServers {
+			ret += fmt.Sprintf("all: %s\n", faultRules[servNum].Str())
+		} else {
+			ret += fmt.Sprintf("server %d: %s\n", servNum, faultRules[servNum].Str())
+		}
+	}
+	return
+}
+
+// Handles the "fault" command from the server prompt
+//
+//	fault                            lists the rules
+//	fault drop|dup SERVER|all CHANCE sets the chance of dropping or duplicating packets
+//	fault delay SERVER|all DURATION  delays packets and dials, like "200ms"
+//	fault partition SERVER...        cuts off all traffic with the servers
+//	fault heal SERVER...|all         removes the rules for the servers
+//	fault clear                      removes every rule
+func HandleFaultCmd(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(FaultRulesStr())
+		return nil
+	}
+
+	switch args[0] {
+	case "drop", "dup", "delay":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: fault %s server|all value", args[0])
+		}
+		servNum, servErr := parseFaultServer(args[1])
+		if servErr != nil {
+			return servErr
+		}
+		rule := GetFaultRule(servNum)
+		if args[0] == "delay" {
+			delay, parseErr := time.ParseDuration(args[2])
+			if parseErr != nil {
+				return parseErr
+			}
+			rule.Delay = delay
+		} else {
+			chance, parseErr := strconv.ParseFloat(args[2], 64)
+			if parseErr != nil || chance < 0 || chance > 1 {
+				return fmt.Errorf("chance should be between 0 and 1, got %s", args[2])
+			}
+			if args[0] == "drop" {
+				rule.Drop = chance
+			} else {
+				rule.Duplicate = chance
+			}
+		}
+		SetFaultRule(servNum, rule)
+	case "partition":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: fault partition server...")
+		}
+		for _, arg := range args[1:] {
+			servNum, servErr := parseFaultServer(arg)
+			if servErr != nil {
+				return servErr
+			}
+			rule := GetFaultRule(servNum)
+			rule.Partitioned = true
+			SetFaultRule(servNum, rule)
+		}
+	case "heal":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: fault heal server...|all")
+		}
+		for _, arg := range args[1:] {
+			servNum, servErr := parseFaultServer(arg)
+			if servErr != nil {
+				return servErr
+			}
+			faultRulesMutex.Lock()
+			if servNum == AllServers {
+				faultRules[AllServers] = FaultRule{}
+			} else {
+				delete(faultRules, servNum)
+			}
+			faultRulesMutex.Unlock()
+		}
+	case "clear":
+		ClearFaultRules()
+	default:
+		return fmt.Errorf("unknown fault command %q", args[0])
+	}
+	fmt.Print(FaultRulesStr())
+	return nil
+}
+
+// Parses a server number from the fault command, or "all" for every server
+func parseFaultServer(arg string) (int, error) {
+	if arg == "all" {
+		return AllServers, nil
+	}
+	servNum, parseErr := strconv.Atoi(arg)
+	if parseErr != nil || GetNode(servNum) == nil {
+		return 0, fmt.Errorf("%s is not a server in the cluster config", arg)
+	}
+	return servNum, nil
+}
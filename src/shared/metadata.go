@@ -0,0 +1,100 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every node advertises a small map of metadata about itself, which is spread along with the
+// membership list. The keys below are filled in by the node itself. Anything else, like role,
+// zone or capacity, comes from the node's Metadata in the cluster config or the meta command.
+// Metadata isn't signed, so where to find a node always comes from the cluster config. The
+// address and ports are only advertised for reference, and have to match the config.
+const (
+	MetaAddress         = "address"
+	MetaGrepPort        = "grep_port"
+	MetaFilePort        = "file_port"
+	MetaMetricsPort     = "metrics_port"
+	MetaSoftwareVersion = "version"
+)
+
+// The version of this build, advertised in every node's metadata.
+// Set it with -ldflags "-X shared.SoftwareVersion=..." when building a release.
+var SoftwareVersion = "dev"
+
+// The most bytes a node's metadata can take up, counting every key and value
+const MaxMetadataSize = 1024
+
+// Returns an error if the metadata is too big or has a key that couldn't be used in a filter
+func CheckMetadata(meta map[string]string) error {
+	size := 0
+	for key, value := range meta {
+		if key == "" || strings.ContainsAny(key, "=, \t\n") {
+			return fmt.Errorf("metadata key %q can't be empty or contain spaces, commas or =", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > MaxMetadataSize {
+		return fmt.Errorf("metadata takes up %d bytes, more than the %d allowed", size, MaxMetadataSize)
+	}
+	return nil
+}
+
+// Parses filters written like "role=storage,zone=a"
+func ParseMetadataFilters(str string) (filters map[string]string, err error) {
+	filters = map[string]string{}
+	for _, filter := range strings.Split(str, ",") {
+		if filter == "" {
+			continue
+		}
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("metadata filter %q should look like key=value", filter)
+		}
+		filters[parts[0]] = parts[1]
+	}
+	return
+}
+
+// Returns whether the metadata has every key set to the value in filters
+func MetadataMatches(meta map[string]string, filters map[string]string) bool {
+	for key, value := range filters {
+		if have, ok := meta[key]; !ok || have != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the metadata as key=value pairs in order of key
+func MetadataStr(meta map[string]string) string {
+	var pairs []string
+	for key, value := range meta {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// Returns the address and ports of the node as the cluster config has them, under their metadata keys
+func EndpointMetadata(servNum int) map[string]string {
+	node := GetNode(servNum)
+	return map[string]string{
+		MetaAddress:     node.Address,
+		MetaGrepPort:    strconv.Itoa(node.Ports.Grep),
+		MetaFilePort:    strconv.Itoa(node.Ports.File),
+		MetaMetricsPort: strconv.Itoa(node.Ports.Metrics),
+	}
+}
+
+// Returns an error if the metadata gives the node an address or port other than the one in the config
+func CheckEndpointMetadata(servNum int, meta map[string]string) error {
+	for key, value := range EndpointMetadata(servNum) {
+		if advertised, ok := meta[key]; ok && advertised != value {
+			return fmt.Errorf("metadata sets %s to %q, but the cluster config has %q", key, advertised, value)
+		}
+	}
+	return nil
+}
@@ -1,11 +1,9 @@
 package shared
 
 import (
-	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -20,42 +18,89 @@ const SwimPingPort = 5678
 const SwimACKPort = 5679
 const SwimIntroducerPort = 5680
 const FilePort = 5681
+const MetricsPort = 5682
+
+// Where SDFS files are stored if the cluster config doesn't say
+const DefaultDataDir = "sdfs_files/"
 
 // If enabled, will output verbose grep loggings to a log file
 const OutputGrepToLog = false
 // Print out things related to failure detection
 var PrintFailDetectInfo = false
 
-// The number of servers we are using
-const NumServers = 10
 const FingerTableSize = 4
+// How many other servers to ask to ping a server that missed an ACK, before marking it failed
+const IndirectProbes = 3
+// How many servers have to ACK that we left before we exit, how long we wait for them,
+// and how often we tell the rest again
+const LeaveACKs = 3
+const LeaveTimeout = 2 * time.Second
+const LeaveResendInterval = 200 * time.Millisecond
 const NumFileReplicas = 4
 
-// How long to wait to get the membership list from the introducer
+// How long to wait for a seed to send back the membership list
 const IntroducerTimeout = 3 * time.Second
+// How long to wait before asking the seeds to join again, doubling every time up to the max
+const JoinRetryBackoff = 1 * time.Second
+const MaxJoinRetryBackoff = 30 * time.Second
 const GrepTimeout = 5 * time.Second
-const ACKTimeout = 1000 * time.Millisecond
-const PingInterval = 1500 * time.Millisecond
-
-// Simulate false positives by dropping packets before they are sent out
+// How long a server stays suspected before it is declared failed, if the cluster config doesn't say
+const DefaultSuspicionTimeout = 3 * time.Second
+// Defaults for how many times membership updates are piggybacked, and how many go on each ping
+const DefaultRetransmitMult = 3
+const DefaultMaxPiggyback = 32
+// Defaults for the alltoall and gossip heartbeat detectors
+const DefaultHeartbeatInterval = 1000 * time.Millisecond
+const DefaultHeartbeatTimeout = 4 * time.Second
+const DefaultGossipFanout = 3
+// Defaults for the phi accrual detector
+const DefaultPhiThreshold = 8.0
+const DefaultPhiWindow = 100
+// Defaults for partition detection, and how often to try merging with failed servers
+const DefaultPartitionFraction = 0.3
+const DefaultPartitionWindow = 15 * time.Second
+const DefaultMergeInterval = 5 * time.Second
+// How long failed and left servers stay in the membership list by default
+const DefaultTombstoneExpiry = time.Minute
+// Defaults for the bounds on ACK timeouts and the ping interval, which are worked out from measured round trip times
+const DefaultMinACKTimeout = 200 * time.Millisecond
+const DefaultMaxACKTimeout = 1000 * time.Millisecond
+const DefaultMinPingInterval = 600 * time.Millisecond
+const DefaultMaxPingInterval = 2000 * time.Millisecond
+const DefaultRTTMultiplier = 4.0
+// How often the membership list is saved to disk by default
+const DefaultSnapshotInterval = 5 * time.Second
+// How many membership changes are kept in the history by default
+const DefaultHistoryLength = 1000
+// The highest the local health score goes by default, stretching timeouts up to 9 times
+const DefaultMaxLocalHealth = 8
+// How many of the latest round trip times are remembered for each server
+const RTTWindow = 32
+// The least spread assumed between round trip times, so a steady link still leaves some slack
+const MinRTTStdDev = 5 * time.Millisecond
+// The least spread the phi detector assumes between ACK gaps, so steady ACKs don't make it jumpy
+const PhiMinStdDev = 150 * time.Millisecond
+
+// How old a signed failure detector message can be before it is rejected as a replay
+const AuthReplayWindow = 30 * time.Second
+
+// Simulate false positives by dropping packets before they are sent out.
+// This is the starting drop chance for every server, the fault command can change it at runtime.
 const FalsePosChance = 0.0
 
-// Channel between membership list and replication logic
-var GlobalMembershipChannel = make(chan MemLists, 5)
-
-// Given the servNum, returns address in form of fa18-cs425-g27-{SERVNUM}.cs.illinois.edu
+// Given the servNum, returns the address of that server from the cluster config
 func GetServerAddressFromNumber(servNum int) (serverAddress string) {
-	serverAddress = "fa18-cs425-g27-"
-	if servNum != 10 {
-		serverAddress += fmt.Sprintf("0%d%s", servNum, ".cs.illinois.edu")
-	} else {
-		serverAddress += fmt.Sprintf("%d%s", servNum, ".cs.illinois.edu")
+	if node := GetNode(servNum); node != nil {
+		serverAddress = node.Address
 	}
 	return
 }
 
 // Returns a Log object that outputs logs to the specified file
+// Relative names are placed in this node's log folder.
 func OpenLogFile(name string) *log.Logger {
+	name = LogPath(name)
+	os.MkdirAll(filepath.Dir(name), os.ModePerm)
 	logFile, logFileErr := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if logFileErr != nil {
 		log.Fatalf("error opening logfile: %v", logFileErr)
@@ -64,23 +109,33 @@ func OpenLogFile(name string) *log.Logger {
 	return logger
 }
 
+// Returns where a file with the given name belongs in this node's log folder
+func LogPath(name string) string {
+	if filepath.IsAbs(name) || ownServerNum == 0 {
+		return name
+	}
+	return filepath.Join(OwnNode().LogDir, name)
+}
+
+// Looks our number up by hostname the first time, unless -id set it.
+// main calls it before starting any goroutines, so later calls only read it.
 func GetOwnServerNumber() (servNum int) {
-	hostname, _ := exec.Command("hostname").Output()
-	serverAddress := fmt.Sprintf("%s", hostname)
-	servNum = GetServerNumberFromString(serverAddress)
+	if ownServerNum == 0 {
+		ownServerNum = lookupOwnServerNumber()
+	}
+	servNum = ownServerNum
 	return
 }
 
+// Returns the number of the server with the given hostname, or 0 if it isn't in the cluster.
+// Short hostnames match the first part of a fully qualified address.
 func GetServerNumberFromString(serverAddress string) (servNum int) {
-	server := strings.Split(serverAddress, "fa18-cs425-g27-")
-	if len(server) != 2 {
-		panic("This is not one of the VMs, exiting execution.\n")
-	}
-	serverAddress = strings.Split(server[1], ".cs.illinois.edu")[0]
-	if serverAddress[0] == '0' {
-		servNum, _ = strconv.Atoi(string(serverAddress[1]))
-	} else {
-		servNum, _ = strconv.Atoi(serverAddress)
+	serverAddress = strings.TrimSpace(serverAddress)
+	for _, node := range Config.Nodes {
+		if node.Address == serverAddress || strings.Split(node.Address, ".")[0] == serverAddress {
+			servNum = node.Id
+			return
+		}
 	}
 	return
 }
@@ -96,15 +151,36 @@ type FileArgs struct {
 	LocalFname, SdfsFname string
 	FileContents []byte
 	NumVersions int
+	// When a put was made, set once by the client so every replica stamps the file with it
+	PutTime time.Time
+}
+// A replica being copied to another server, which merges it into its versions of the file by ModTime
+type ReplicaArgs struct {
+	SdfsFname    string
+	FileContents []byte
+	ModTime      time.Time
 }
 type FileReply struct {
 	OnMachine bool
 	FileContents []byte
 }
 
-type MemLists struct {
-	OldList []bool
-	NewList []bool
+// ==== Membership ==== //
+
+// Asks for the metadata of one server, or of every alive server the answering server knows if ServNum is 0
+type MetadataArgs struct {
+	ServNum int
+}
+// A server's metadata, as advertised by the server itself
+type ServerMetadata struct {
+	ServNum int
+	// Which run of the server it belongs to, and which version of it this is in that run
+	Run     time.Time
+	Version uint64
+	Meta    map[string]string
+}
+type MetadataReply struct {
+	Servers []ServerMetadata
 }
 
 // ======= Grep ======= //
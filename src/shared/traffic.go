@@ -0,0 +1,259 @@
+package shared
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Counts the bytes and messages this process sends to and receives from every server, by kind
+// of traffic: each failure detector message type, and the file and grep RPCs. Rates are worked
+// out over the last TrafficRateWindow, one bucket per second. The counts are printed by the
+// traffic command, and served in the Prometheus text format on the metrics port.
+
+// Kinds of traffic that aren't failure detector messages
+const (
+	FileRPCTraffic = "FileRPC"
+	GrepRPCTraffic = "GrepRPC"
+	// Packets that couldn't be decoded
+	InvalidTraffic = "Invalid"
+)
+
+// Peer used for traffic we can't tell the server of, like RPCs from a shared address
+const UnknownPeer = 0
+
+// How far back the traffic rates look
+const TrafficRateWindow = 10 * time.Second
+
+type trafficKey struct {
+	Kind string
+	Peer int
+	Sent bool
+}
+
+type trafficBucket struct {
+	second   int64
+	messages uint64
+	bytes    uint64
+}
+
+type trafficCounter struct {
+	messages uint64
+	bytes    uint64
+	recent   [TrafficRateWindow / time.Second]trafficBucket
+}
+
+var traffic = map[trafficKey]*trafficCounter{}
+var trafficMutex sync.Mutex
+
+// Counts a message of the given kind sent to or received from the peer
+func CountTraffic(kind string, peer int, sent bool, bytes int) {
+	countTraffic(kind, peer, sent, 1, bytes)
+}
+
+func countTraffic(kind string, peer int, sent bool, messages int, bytes int) {
+	now := time.Now().Unix()
+
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	key := trafficKey{kind, peer, sent}
+	counter, ok := traffic[key]
+	if !ok {
+		counter = &trafficCounter{}
+		traffic[key] = counter
+	}
+	counter.messages += uint64(messages)
+	counter.bytes += uint64(bytes)
+
+	bucket := &counter.recent[now%int64(len(counter.recent))]
+	if bucket.second != now {
+		*bucket = trafficBucket{second: now}
+	}
+	bucket.messages += uint64(messages)
+	bucket.bytes += uint64(bytes)
+}
+
+// Returns the messages and bytes per second over the last TrafficRateWindow.
+// This function assumes you already have the traffic lock.
+func (counter *trafficCounter) rates() (messages, bytes float64) {
+	now := time.Now().Unix()
+	for _, bucket := range counter.recent {
+		if now-bucket.second < int64(len(counter.recent)) {
+			messages += float64(bucket.messages)
+			bytes += float64(bucket.bytes)
+		}
+	}
+	seconds := TrafficRateWindow.Seconds()
+	return messages / seconds, bytes / seconds
+}
+
+// Returns the counted keys in order of kind, direction and peer.
+// This function assumes you already have the traffic lock.
+func sortedTrafficKeys() (keys []trafficKey) {
+	for key := range traffic {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kind != keys[j].Kind {
+			return keys[i].Kind < keys[j].Kind
+		}
+		if keys[i].Sent != keys[j].Sent {
+			return keys[i].Sent
+		}
+		return keys[i].Peer < keys[j].Peer
+	})
+	return
+}
+
+func direction(sent bool) string {
+	if sent {
+		return "sent"
+	}
+	return "received"
+}
+
+// Returns a table of the traffic by kind, or by kind and peer
+func TrafficStr(byPeer bool) string {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	type row struct {
+		messages, bytes uint64
+		msgRate, rate   float64
+	}
+	var order []trafficKey
+	rows := map[trafficKey]*row{}
+	for _, key := range sortedTrafficKeys() {
+		counter := traffic[key]
+		if !byPeer {
+			key.Peer = UnknownPeer
+		}
+		if rows[key] == nil {
+			rows[key] = &row{}
+			order = append(order, key)
+		}
+		msgRate, rate := counter.rates()
+		rows[key].messages += counter.messages
+		rows[key].bytes += counter.bytes
+		rows[key].msgRate += msgRate
+		rows[key].rate += rate
+	}
+
+	ret := fmt.Sprintf("%-11s %-9s", "Kind", "")
+	if byPeer {
+		ret += fmt.Sprintf(" %-6s", "Peer")
+	}
+	ret += fmt.Sprintf(" %10s %12s %10s %12s\n", "Messages", "Bytes", "Msgs/s", "Bytes/s")
+	for _, key := range order {
+		row := rows[key]
+		ret += fmt.Sprintf("%-11s %-9s", key.Kind, direction(key.Sent))
+		if byPeer {
+			peer := "?"
+			if key.Peer != UnknownPeer {
+				peer = fmt.Sprint(key.Peer)
+			}
+			ret += fmt.Sprintf(" %-6s", peer)
+		}
+		ret += fmt.Sprintf(" %10d %12d %10.1f %12.1f\n", row.messages, row.bytes, row.msgRate, row.rate)
+	}
+	return ret
+}
+
+// Writes every counter in the Prometheus text format
+func serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics := []struct {
+		name, help, kind string
+		value            func(counter *trafficCounter) float64
+	}{
+		{"ece428_traffic_messages_total", "Messages sent or received.", "counter",
+			func(counter *trafficCounter) float64 { return float64(counter.messages) }},
+		{"ece428_traffic_bytes_total", "Bytes sent or received.", "counter",
+			func(counter *trafficCounter) float64 { return float64(counter.bytes) }},
+		{"ece428_traffic_messages_per_second", "Messages per second over the last 10 seconds.", "gauge",
+			func(counter *trafficCounter) float64 { rate, _ := counter.rates(); return rate }},
+		{"ece428_traffic_bytes_per_second", "Bytes per second over the last 10 seconds.", "gauge",
+			func(counter *trafficCounter) float64 { _, rate := counter.rates(); return rate }},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, key := range sortedTrafficKeys() {
+			fmt.Fprintf(writer, "%s{node=\"%d\",kind=\"%s\",peer=\"%d\",direction=\"%s\"} %g\n",
+				metric.name, GetOwnServerNumber(), key.Kind, key.Peer, direction(key.Sent), metric.value(traffic[key]))
+		}
+	}
+}
+
+// Serves the traffic counters at /metrics on this node's metrics port
+func ServeMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	address := fmt.Sprintf(":%d", OwnNode().Ports.Metrics)
+	if serveErr := http.ListenAndServe(address, mux); serveErr != nil {
+		fmt.Printf("Couldn't serve metrics on %s: %v\n", address, serveErr)
+	}
+}
+
+// Returns the server at the address, or UnknownPeer if no server or more than one server has it
+func PeerFromAddr(addr net.Addr) int {
+	host, _, splitErr := net.SplitHostPort(addr.String())
+	if splitErr != nil {
+		return UnknownPeer
+	}
+	peer := UnknownPeer
+	for _, node := range Config.Nodes {
+		if node.Address == host {
+			if peer != UnknownPeer {
+				return UnknownPeer
+			}
+			peer = node.Id
+		}
+	}
+	return peer
+}
+
+// A connection that counts the traffic through it. The first write and the first read each
+// count as a message, since every RPC connection is used for a single call.
+type countingConn struct {
+	net.Conn
+	kind           string
+	peer           int
+	wrote, didRead bool
+}
+
+// Wraps the connection so its traffic is counted as the given kind
+func CountConn(conn net.Conn, kind string, peer int) net.Conn {
+	return &countingConn{Conn: conn, kind: kind, peer: peer}
+}
+
+func (conn *countingConn) Read(buf []byte) (n int, err error) {
+	n, err = conn.Conn.Read(buf)
+	if n > 0 {
+		messages := 0
+		if !conn.didRead {
+			conn.didRead = true
+			messages = 1
+		}
+		countTraffic(conn.kind, conn.peer, false, messages, n)
+	}
+	return
+}
+
+func (conn *countingConn) Write(buf []byte) (n int, err error) {
+	n, err = conn.Conn.Write(buf)
+	if n > 0 {
+		messages := 0
+		if !conn.wrote {
+			conn.wrote = true
+			messages = 1
+		}
+		countTraffic(conn.kind, conn.peer, true, messages, n)
+	}
+	return
+}
@@ -0,0 +1,19 @@
+#!/usr/bin/env bash
+# Runs a whole cluster on this machine, one server per tmux pane.
+# Usage: ./local-tmux.sh [number of nodes, default 10]
+NUM_NODES=${1:-10}
+# Every node needs the same key, set CLUSTER_KEY to use your own
+CLUSTER_KEY=${CLUSTER_KEY:-local}
+
+cd "$(dirname "$0")/../src" || exit 1
+make || exit 1
+
+# Node 1 is the introducer, so it has to be up before the others join
+tmux new-session -d "./ece428 -local $NUM_NODES -id 1 -cluster_key $CLUSTER_KEY"
+for i in $(seq 2 "$NUM_NODES"); do
+    sleep 0.5
+    tmux split-window "./ece428 -local $NUM_NODES -id $i -cluster_key $CLUSTER_KEY"
+    tmux select-layout tiled
+done
+
+tmux -2 attach-session -d